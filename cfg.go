@@ -47,41 +47,425 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"os/user"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	// Default QoS for the topic subscriptions
+	TOPIC_QOS = 1
+	// Name of the top level Broker when used along with Sections
+	DEFAULT_SECTION = "default"
+	// Policies for the retained messages
+	RETAINED_RECORD = "record"
+	RETAINED_MARK   = "mark"
+	RETAINED_DROP   = "drop"
+	// Topic filter for the Broker statistics
+	SYS_TOPIC = "$SYS/#"
+	// Longest Client ID every MQTT 3.1.1 Broker has to accept
+	CLIENT_ID_MAX = 23
+	// Longest random part of the Client ID
+	CLIENT_ID_RAND_MAX = 32
+	// Replacement for the secrets when printing the configuration
+	REDACTED = "xxxxx"
+)
+
+// clientIDPlaceholder matches the placeholders in the Client ID such as
+// "{hostname}" or "{rand:8}".
+var clientIDPlaceholder = regexp.MustCompile(`\{([a-z]+)(?::([0-9]+))?\}`)
+
+// retainedPolicies are the supported policies for retained messages.
+var retainedPolicies = []string{
+	"",
+	RETAINED_RECORD,
+	RETAINED_MARK,
+	RETAINED_DROP,
+}
+
 // cfg stores Configuration for MQTT and Topics needed for logging.
 type cfg struct {
+	Name           string
 	ADDR           string
+	Brokers        []string
 	Username       string
 	Password       string
+	Credentials    credentialsOptions
 	CAFile         string
 	ClientID       string
 	ClientCertFile string
 	ClientKeyFile  string
-	Topics         []string
+	TLS            tlsOptions
+	Reconnect      reconnectOptions
+	ConnectRetry   connectRetryOptions
+	Connection     connectionOptions
+	Session        sessionOptions
+	Subscribe      subscribeOptions
+	WebSocket      websocketOptions
+	Proxy          proxyOptions
+	Status         statusOptions
+	Control        controlOptions
+	Topics         []topic
+	// SharedGroup subscribes to all the topics as a shared subscription
+	// "$share/<SharedGroup>/<filter>" to balance among several loggers.
+	SharedGroup string
+	// InstanceID tags the records and the log file of this logger.
+	// Top level only.
+	InstanceID string
+	// Columns are the optional message metadata columns to record,
+	// among "QoS", "Retained", "Duplicate" and "MessageID". Top level
+	// only.
+	Columns []string
+	// Retained is the policy for retained messages delivered upon
+	// subscription: "record" as usual (default), "mark" them or "drop".
+	Retained string
+	// SysStats subscribes to the Broker "$SYS/#" statistics and records
+	// them into a separate log file.
+	SysStats bool
+	// ProtocolVersion of MQTT: 3 for 3.1, 4 for 3.1.1 (default) or 5.
+	ProtocolVersion byte
+	// MQTT5 are the subscription and session settings for MQTT 5.
+	MQTT5 mqtt5Options
+	// Sections are the additional named Brokers logged in parallel,
+	// each with its own settings.
+	Sections []cfg
+	// sources of the values from the environment, set by Load.
+	sources []cfgSource
+}
+
+// reconnectOptions stores the settings for automatic reconnection to the
+// MQTT Broker after the connection is lost.
+type reconnectOptions struct {
+	// Disabled stops the logging session on connection loss instead of
+	// trying to reconnect.
+	Disabled bool
+	// MaxInterval is the upper limit for the exponential backoff between
+	// the reconnection attempts, e.g. "2m". Default is 10 minutes.
+	// Lower it to resume logging sooner after long outages.
+	MaxInterval duration
+}
+
+// credentialsOptions stores the settings for getting a fresh password,
+// such as a short lived token, before every connection attempt.
+type credentialsOptions struct {
+	// Command with its arguments that prints the password, e.g.
+	// ["/usr/local/bin/get-token", "--audience", "mqtt"].
+	Command []string
+	// File containing the password, refreshed by another process.
+	File string
+	// Timeout for the Command. Default is 10 seconds.
+	Timeout duration
+}
+
+// tlsOptions stores the additional TLS settings used for secure
+// connections to the MQTT Broker.
+type tlsOptions struct {
+	// ServerName overrides the host name used to verify the Broker
+	// certificate.
+	ServerName string
+	// InsecureSkipVerify disables the verification of the Broker
+	// certificate. Only meant for lab Brokers.
+	InsecureSkipVerify bool
+	// MinVersion is the minimum TLS version such as "1.2" or "1.3".
+	MinVersion string
+	// CipherSuites lists the allowed cipher suite names for TLS 1.2
+	// and below, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+	CipherSuites []string
+	// UseSystemRoots adds the CAFile on top of the system trust store
+	// instead of replacing it.
+	UseSystemRoots bool
+}
+
+// connectRetryOptions stores the settings for retrying the initial
+// connection to the MQTT Broker at startup.
+type connectRetryOptions struct {
+	// Enabled turns on the retries, else the first failure is final.
+	Enabled bool
+	// InitialDelay is the wait after the first failed attempt, which
+	// doubles on every further failure. Default is 1 second.
+	InitialDelay duration
+	// MaxDelay is the upper limit for the wait between attempts.
+	// Default is 1 minute.
+	MaxDelay duration
+	// MaxAttempts is the number of attempts before giving up,
+	// 0 means retry forever.
+	MaxAttempts int
+}
+
+// connectionOptions stores the keep alive, timeouts and buffering of
+// the connection to the MQTT Broker. Zero values keep the defaults.
+type connectionOptions struct {
+	// KeepAlive is the interval of the PING requests that keep the
+	// connection alive, in whole seconds. Shorten it below the NAT
+	// timeout of cellular gateways. Default is 30 seconds.
+	KeepAlive duration
+	// PingTimeout is the wait for the PING response before the
+	// connection is considered lost, shorter than the keep alive.
+	// Default is 10 seconds, or half the keep alive if not shorter.
+	// Not available with MQTT 5.
+	PingTimeout duration
+	// ConnectTimeout limits the time for opening the connection.
+	// Default is 30 seconds.
+	ConnectTimeout duration
+	// WriteTimeout limits the time for sending a packet to the Broker.
+	// Default is no limit. Not available with MQTT 5.
+	WriteTimeout duration
+	// ChannelDepth is the number of received messages buffered for
+	// recording. Raise it for high throughput captures.
+	// Default is twice the number of topics.
+	ChannelDepth int
+}
+
+// sessionOptions stores the settings for persistent MQTT sessions that
+// survive reconnections and restarts of the logger.
+type sessionOptions struct {
+	// Persistent keeps the session on the Broker instead of starting a
+	// clean session. Needs a stable ClientID.
+	Persistent bool
+	// StoreDir is the directory for the in-flight messages on disk.
+	// Default is "mqtt-store".
+	StoreDir string
+}
+
+// subscribeOptions stores the settings for handling the subscription
+// results from the MQTT Broker.
+type subscribeOptions struct {
+	// AllowDenied only warns about subscriptions rejected by the Broker,
+	// else a rejection stops the logging session.
+	AllowDenied bool
+	// BatchSize is the maximum number of topic filters sent in a single
+	// SUBSCRIBE packet. Default is 32.
+	BatchSize int
+}
+
+// websocketOptions stores the settings for connecting to the MQTT Broker
+// over "ws://" or "wss://" addresses. The path is part of the address,
+// e.g. "wss://broker.example.com:443/mqtt".
+type websocketOptions struct {
+	// Headers are the extra HTTP headers sent in the WebSocket handshake,
+	// such as an API key needed by a gateway.
+	Headers map[string]string
+	// ReadBufferSize and WriteBufferSize are the WebSocket I/O buffer
+	// sizes in bytes. Default is 4096.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// NoProxy ignores the HTTP(S)_PROXY environment variables for the
+	// WebSocket connection.
+	NoProxy bool
+}
+
+// proxyOptions stores the settings for reaching the MQTT Broker through
+// a SOCKS5 or HTTP CONNECT proxy.
+type proxyOptions struct {
+	// URL of the proxy such as "socks5://proxy:1080" or
+	// "http://proxy:3128". The WebSocket addresses cannot use a
+	// "https://" proxy.
+	URL string
+	// Username and Password for the proxy if needed.
+	Username string
+	Password string
+	// FromEnvironment uses the ALL_PROXY or HTTPS_PROXY environment
+	// variables when no URL is given, honoring NO_PROXY.
+	FromEnvironment bool
+}
+
+// statusOptions stores the settings for the status messages of the
+// logger itself, published retained as "online" after connecting,
+// "stopped" upon shutdown and "offline" as the Last Will.
+type statusOptions struct {
+	// Topic for the status messages, empty disables them. "{clientid}"
+	// is replaced by the Client ID, e.g. "go-mli/{clientid}/status".
+	Topic string
+	// QoS for the status messages 0, 1 or 2.
+	QoS byte
+}
+
+// mqtt5Options stores the settings only available with MQTT 5.
+type mqtt5Options struct {
+	// NoLocal skips the messages published by the logger itself. Not
+	// allowed with shared subscriptions.
+	NoLocal bool
+	// RetainHandling controls the retained messages upon subscription:
+	// 0 send them (default), 1 only for new subscriptions, 2 never.
+	RetainHandling byte
+	// RetainAsPublished keeps the retain flag as set by the publisher.
+	// Only with the "record" retained policy, as live messages would be
+	// marked or dropped as well.
+	RetainAsPublished bool
+	// SessionExpiry keeps the session on the Broker after disconnection
+	// for this long, e.g. "24h". Needed with a persistent session.
+	SessionExpiry duration
+}
+
+// controlOptions stores the settings for controlling the logger at
+// runtime through JSON commands on a MQTT topic.
+type controlOptions struct {
+	// Topic for the commands, empty disables the control. "{clientid}"
+	// is replaced by the Client ID, e.g. "go-mli/{clientid}/control".
+	// Retained commands are refused.
+	Topic string
+	// ResponseTopic for the replies. Default is the Topic with
+	// "/response" appended.
+	ResponseTopic string
+	// Token needed in every command to be accepted.
+	Token string
+	// QoS for the commands and replies 0, 1 or 2.
+	QoS byte
+}
+
+// topic stores the subscription options for a single topic filter.
+// In the configuration file it can either be a plain string with the
+// filter or an object with the individual options.
+type topic struct {
+	// Filter is the MQTT topic filter to subscribe to.
+	Filter string
+	// QoS is the subscription quality of service 0, 1 or 2. Default is 1.
+	QoS byte
+	// Alias is the human readable name recorded instead of the topic.
+	Alias string
+	// Enabled allows to switch off a topic without removing it.
+	// Default is true.
+	Enabled bool
+	// Retained is the policy for retained messages of this topic, else
+	// the global policy applies.
+	Retained string
+}
+
+// newTopic creates a topic for the filter with the default options.
+func newTopic(filter string) topic {
+	return topic{Filter: filter, QoS: TOPIC_QOS, Enabled: true}
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface to accept both
+// the plain string and the object form.
+func (t *topic) UnmarshalJSON(b []byte) error {
+	var filter string
+	if err := json.Unmarshal(b, &filter); err == nil {
+		*t = newTopic(filter)
+		return nil
+	}
+	// Avoid recursion into this method
+	type topicObj topic
+	v := topicObj(newTopic(""))
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("invalid topic %s: %v", string(b), err)
+	}
+	if len(v.Filter) == 0 {
+		return fmt.Errorf("missing filter in topic %s", string(b))
+	}
+	if v.QoS > 2 {
+		return fmt.Errorf("invalid qos %d for topic %q", v.QoS, v.Filter)
+	}
+	if !slices.Contains(retainedPolicies, v.Retained) {
+		return fmt.Errorf("invalid retained policy %q for topic %q",
+			v.Retained, v.Filter)
+	}
+	*t = topic(v)
+	return nil
 }
 
-// Load helps to read the supplied JSON file and fill up the configuration.
+// MarshalJSON implements the json.Marshaler interface to write back topics
+// with only default options as plain strings.
+func (t topic) MarshalJSON() ([]byte, error) {
+	if t == newTopic(t.Filter) {
+		return json.Marshal(t.Filter)
+	}
+	type topicObj topic
+	return json.Marshal(topicObj(t))
+}
+
+// Name returns the name to record for a message received on the topic,
+// which is the alias if available else the actual received topic.
+func (t topic) Name(received string) string {
+	if len(t.Alias) > 0 {
+		return t.Alias
+	}
+	return received
+}
+
+// duration is a time.Duration that is stored as a human readable string
+// such as "1m30s" in the configuration file.
+type duration time.Duration
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", string(b), err)
+	}
+	if v < 0 {
+		return fmt.Errorf("negative duration %q", string(b))
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Load helps to read the supplied JSON, YAML or TOML file, chosen by the
+// extension, and fill up the configuration. The "${VAR}" references in the
+// string values are expanded and the "MLI_" environment variables override
+// the top level fields afterwards.
 func (m *cfg) Load(Filename string) error {
 	bs, err := os.ReadFile(Filename)
 	if err != nil {
 		return fmt.Errorf("failed to load file %q :\n %v", Filename, err)
 	}
 
-	err = json.Unmarshal(bs, m)
+	var sources []cfgSource
+	var file map[string]json.RawMessage
+	bs, err = decodeCfg(cfgFormat(Filename), bs)
+	if err == nil {
+		err = json.Unmarshal(bs, &file)
+	}
+	if err == nil {
+		bs, err = expandCfgEnv(bs, &sources)
+	}
+	if err == nil {
+		err = json.Unmarshal(bs, m)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to process the file %q :\n %v", Filename, err)
 	}
+	m.sources = sources
+
+	err = m.applyEnvOverrides(file)
+	if err != nil {
+		return fmt.Errorf("failed to override the configuration:\n %v", err)
+	}
 
 	return nil
 }
 
-// Save helps to save back the configuration into the supplied JSON file.
+// Save helps to save back the configuration into the supplied JSON, YAML
+// or TOML file, chosen by the extension. The values taken from the
+// environment are written as they were in the loaded file.
 func (m *cfg) Save(Filename string) error {
+	return m.save(Filename, nil)
+}
+
+// save writes the configuration file with the comments for the fields,
+// keyed as needed by encodeCfg.
+func (m *cfg) save(Filename string, comments map[string]string) error {
 	bs, err := json.MarshalIndent(m, "", "    ")
+	if err == nil && len(m.sources) > 0 {
+		bs, err = restoreCfgEnv(bs, m.sources)
+	}
+	if err == nil {
+		bs, err = encodeCfg(cfgFormat(Filename), bs, comments)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to encode back configuration:\n %v", err)
 	}
@@ -94,30 +478,307 @@ func (m *cfg) Save(Filename string) error {
 	return nil
 }
 
-// String implements the Stringer interface to print out the configuration.
+// brokerList returns the Broker addresses to try in order, starting with
+// ADDR if available followed by the Brokers without any duplicates.
+func (m cfg) brokerList() []string {
+	var list []string
+	seen := make(map[string]bool)
+	for _, b := range append([]string{m.ADDR}, m.Brokers...) {
+		if len(b) == 0 || seen[b] {
+			continue
+		}
+		seen[b] = true
+		list = append(list, b)
+	}
+	return list
+}
+
+// subscribeTopics returns the topics to subscribe to, turned into shared
+// subscriptions when the SharedGroup is available. The global retained
+// policy applies to the topics without their own.
+func (m cfg) subscribeTopics() []topic {
+	list := make([]topic, 0, len(m.Topics))
+	for _, t := range m.Topics {
+		if len(t.Retained) == 0 {
+			t.Retained = m.Retained
+		}
+		if len(m.SharedGroup) > 0 {
+			t.Filter = "$share/" + m.SharedGroup + "/" + t.Filter
+		}
+		list = append(list, t)
+	}
+	// Broker statistics are never shared and mostly retained
+	if m.SysStats {
+		list = append(list, topic{Filter: SYS_TOPIC, QoS: 0, Enabled: true,
+			Retained: RETAINED_RECORD})
+	}
+	return list
+}
+
+// sessions returns the configurations of all the Brokers to log from in
+// parallel. Without Sections this is the configuration itself, else the
+// top level Broker if any followed by each of the Sections. The Columns
+// and InstanceID apply to the shared log file, so only at the top level.
+func (m cfg) sessions() ([]cfg, error) {
+	if len(m.Sections) == 0 {
+		if !slices.Contains(retainedPolicies, m.Retained) {
+			return nil, fmt.Errorf("invalid retained policy %q", m.Retained)
+		}
+		return []cfg{m}, nil
+	}
+	// The log file and its columns are shared by all the Brokers
+	for _, s := range m.Sections {
+		if len(s.Columns) > 0 || len(s.InstanceID) > 0 {
+			return nil, fmt.Errorf("columns and instance ID are only "+
+				"supported at the top level, not in section %q", s.Name)
+		}
+	}
+	var list []cfg
+	if len(m.brokerList()) > 0 {
+		top := m
+		top.Sections = nil
+		if len(top.Name) == 0 {
+			top.Name = DEFAULT_SECTION
+		}
+		list = append(list, top)
+	}
+	list = append(list, m.Sections...)
+	names := make(map[string]bool)
+	for _, s := range list {
+		if len(s.Name) == 0 {
+			return nil, fmt.Errorf("missing name for broker section %v",
+				s.brokerList())
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate broker section %q", s.Name)
+		}
+		if len(s.Sections) > 0 {
+			return nil, fmt.Errorf("nested sections in %q", s.Name)
+		}
+		if !slices.Contains(retainedPolicies, s.Retained) {
+			return nil, fmt.Errorf("invalid retained policy %q in %q",
+				s.Retained, s.Name)
+		}
+		names[s.Name] = true
+	}
+	return list, nil
+}
+
+// expandClientID resolves the placeholders in the supplied Client ID, so
+// that several loggers can share the same configuration without taking
+// over each others session. Supported are "{hostname}", "{pid}", "{user}"
+// and "{rand:N}" for N random hex characters.
+func expandClientID(id string) (string, error) {
+	var err error
+	expanded := clientIDPlaceholder.ReplaceAllStringFunc(id,
+		func(p string) string {
+			match := clientIDPlaceholder.FindStringSubmatch(p)
+			name, arg := match[1], match[2]
+			if len(arg) > 0 && name != "rand" {
+				err = fmt.Errorf("placeholder %q takes no length", p)
+				return p
+			}
+			switch name {
+			case "hostname":
+				h, e := os.Hostname()
+				if e != nil {
+					err = fmt.Errorf("failed to get hostname:\n %v", e)
+				}
+				return h
+			case "pid":
+				return strconv.Itoa(os.Getpid())
+			case "user":
+				u, e := user.Current()
+				if e != nil {
+					err = fmt.Errorf("failed to get user:\n %v", e)
+					return p
+				}
+				// Leave out the Windows domain
+				name := u.Username
+				if i := strings.LastIndex(name, `\`); i >= 0 {
+					name = name[i+1:]
+				}
+				return name
+			case "rand":
+				n, _ := strconv.Atoi(arg)
+				if n < 1 || n > CLIENT_ID_RAND_MAX {
+					err = fmt.Errorf("placeholder %q needs a length of "+
+						"1 to %d", p, CLIENT_ID_RAND_MAX)
+					return p
+				}
+				b := make([]byte, (n+1)/2)
+				rand.Read(b)
+				return hex.EncodeToString(b)[:n]
+			}
+			err = fmt.Errorf("unknown placeholder %q in client id", p)
+			return p
+		})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// String implements the Stringer interface to print out the configuration
+// with the secrets redacted.
 func (m cfg) String() string {
-	bs, _ := json.MarshalIndent(m, "", "  ")
+	bs, _ := json.MarshalIndent(m.redacted(), "", "  ")
 	return string(bs)
 }
 
-// writeTemplate helps to create the default JSON file with
-// dummy configuration as a starter.
+// redacted returns a copy of the configuration with the secrets, such as
+// the passwords, tokens and WebSocket headers, replaced by REDACTED.
+func (m cfg) redacted() cfg {
+	redact := func(s string) string {
+		if len(s) == 0 {
+			return s
+		}
+		return REDACTED
+	}
+	m.Password = redact(m.Password)
+	m.Proxy.Password = redact(m.Proxy.Password)
+	if u, err := url.Parse(m.Proxy.URL); err == nil && u.User != nil {
+		m.Proxy.URL = u.Redacted()
+	}
+	m.Control.Token = redact(m.Control.Token)
+	if len(m.WebSocket.Headers) > 0 {
+		headers := make(map[string]string, len(m.WebSocket.Headers))
+		for k, v := range m.WebSocket.Headers {
+			headers[k] = redact(v)
+		}
+		m.WebSocket.Headers = headers
+	}
+	if len(m.Sections) > 0 {
+		sections := make([]cfg, 0, len(m.Sections))
+		for _, s := range m.Sections {
+			sections = append(sections, s.redacted())
+		}
+		m.Sections = sections
+	}
+	return m
+}
+
+// templateComments explain the fields of the template in the formats
+// supporting comments.
+var templateComments = map[string]string{
+	"": "go-mli configuration template\n" +
+		"Fields marked \"-optional\" can be removed when not needed.",
+	"ADDR":                      "Address of the Broker: tcp, ssl, ws, wss or unix",
+	"Brokers":                   "Standby Brokers tried in order when ADDR fails",
+	"Username":                  "Credentials for the Broker",
+	"CAFile":                    "Certificate Authority to verify the Broker",
+	"ClientID":                  "Supports {hostname}, {pid}, {user} and {rand:N}",
+	"ClientCertFile":            "Client certificate and key for mutual TLS",
+	"Credentials":               "Fresh password from a Command or File per connection",
+	"TLS":                       "Additional TLS settings for secure connections",
+	"Reconnect":                 "Automatic reconnection after connection loss",
+	"ConnectRetry":              "Retries for the initial connection at startup",
+	"Connection":                "Keep alive, timeouts and buffering of the connection",
+	"Connection.KeepAlive":      "Shorten below the NAT timeout of cellular gateways",
+	"Connection.PingTimeout":    "Wait for the PING response, shorter than KeepAlive",
+	"Connection.ConnectTimeout": "Limit for opening the connection",
+	"Connection.WriteTimeout":   "Limit for sending a packet, 0s for no limit",
+	"Connection.ChannelDepth":   "Received messages buffered, 0 for twice the topics",
+	"Session":                   "Persistent session kept by the Broker, needs a stable ClientID",
+	"Subscribe":                 "Handling of the subscriptions rejected by the Broker",
+	"WebSocket":                 "Extra settings for ws and wss addresses",
+	"Proxy":                     "SOCKS5 or HTTP CONNECT proxy to reach the Broker",
+	"Status":                    "Retained online, stopped and offline status of the logger",
+	"Control":                   "JSON commands on a topic to control the logger at runtime",
+	"Topics": "Topic filters to record, either a plain filter or with\n" +
+		"QoS, Alias, Enabled and Retained (record, mark or drop)",
+	"Columns":         "Optional metadata columns to record",
+	"Retained":        "Policy for retained messages: record, mark or drop",
+	"ProtocolVersion": "MQTT version: 3 for 3.1, 4 for 3.1.1 or 5",
+	"MQTT5":           "Subscription and session settings only for MQTT 5",
+}
+
+// writeTemplate helps to create the default JSON, YAML or TOML file with
+// dummy configuration as a starter, commented in YAML and TOML.
 func writeTemplate(Filename string) error {
 	m := &cfg{
 		ADDR:           "tcp://192.168.0.0:1883",
+		Brokers:        []string{"tcp://192.168.0.1:1883-optional-standby"},
 		Username:       "Username Here",
 		Password:       "Password Here",
 		CAFile:         "/path/to/ca.crt-optional",
-		ClientID:       "go-mli-demo",
+		ClientID:       "go-mli-{hostname}-{rand:4}",
 		ClientCertFile: "/path/to/user.client.crt-optional",
 		ClientKeyFile:  "/path/to/user.client.key-optional",
-		Topics: []string{
-			"demo",
-			"d1",
-			"Sensor1/Temp",
-			"Sensor1/Humidity",
+		Credentials: credentialsOptions{
+			File: "/path/to/token-optional",
+		},
+		TLS: tlsOptions{
+			MinVersion:     "1.2",
+			UseSystemRoots: true,
+		},
+		Reconnect: reconnectOptions{
+			MaxInterval: duration(2 * time.Minute),
+		},
+		ConnectRetry: connectRetryOptions{
+			Enabled:      true,
+			InitialDelay: duration(time.Second),
+			MaxDelay:     duration(time.Minute),
+		},
+		Connection: connectionOptions{
+			KeepAlive:      duration(30 * time.Second),
+			PingTimeout:    duration(10 * time.Second),
+			ConnectTimeout: duration(30 * time.Second),
+			WriteTimeout:   duration(0),
+			ChannelDepth:   0,
+		},
+		Session: sessionOptions{
+			Persistent: false,
+			StoreDir:   "mqtt-store",
+		},
+		Subscribe: subscribeOptions{
+			AllowDenied: false,
+			BatchSize:   32,
+		},
+		WebSocket: websocketOptions{
+			Headers: map[string]string{
+				"X-Api-Key": "Key Here-optional",
+			},
+		},
+		Proxy: proxyOptions{
+			URL:             "socks5://proxy.local:1080-optional",
+			FromEnvironment: true,
+		},
+		Status: statusOptions{
+			Topic: "go-mli/{clientid}/status",
+			QoS:   1,
+		},
+		Control: controlOptions{
+			Topic: "go-mli/{clientid}/control-optional",
+			Token: "Token Here",
+			QoS:   1,
+		},
+		ProtocolVersion: 4,
+		MQTT5: mqtt5Options{
+			NoLocal:        false,
+			RetainHandling: 0,
+			SessionExpiry:  duration(24 * time.Hour),
+		},
+		Columns:  []string{"QoS", "Retained"},
+		Retained: RETAINED_MARK,
+		Topics: []topic{
+			newTopic("demo"),
+			newTopic("d1"),
+			{
+				Filter:  "Sensor1/Temp",
+				QoS:     0,
+				Alias:   "Temperature",
+				Enabled: true,
+			},
+			{
+				Filter:   "Sensor1/Humidity",
+				QoS:      2,
+				Alias:    "Humidity",
+				Enabled:  false,
+				Retained: RETAINED_DROP,
+			},
 		},
 	}
 
-	return m.Save(Filename)
+	return m.save(Filename, templateComments)
 }
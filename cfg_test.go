@@ -46,7 +46,17 @@
 // Configuration File Handler - Tests
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 func Test_writeTemplate(t *testing.T) {
 	type args struct {
@@ -62,6 +72,16 @@ func Test_writeTemplate(t *testing.T) {
 			args:    args{Filename: "build/config_template.json"},
 			wantErr: false,
 		},
+		{
+			name:    "YAML Template",
+			args:    args{Filename: "build/config_template.yaml"},
+			wantErr: false,
+		},
+		{
+			name:    "TOML Template",
+			args:    args{Filename: "build/config_template.toml"},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -71,3 +91,537 @@ func Test_writeTemplate(t *testing.T) {
 		})
 	}
 }
+
+func Test_writeTemplate_formats(t *testing.T) {
+	dir := t.TempDir()
+	var want cfg
+	jsonFile := filepath.Join(dir, "config.json")
+	if err := writeTemplate(jsonFile); err != nil {
+		t.Fatalf("writeTemplate() error = %v", err)
+	}
+	if err := want.Load(jsonFile); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	for _, name := range []string{"config.yaml", "config.yml", "config.toml"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(dir, name)
+			if err := writeTemplate(file); err != nil {
+				t.Fatalf("writeTemplate() error = %v", err)
+			}
+			bs, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read the template: %v", err)
+			}
+			if !strings.Contains(string(bs), "# Address of the Broker") ||
+				!strings.Contains(string(bs), "# Wait for the PING response") {
+				t.Errorf("writeTemplate() missing comments:\n%s", bs)
+			}
+			var got cfg
+			if err := got.Load(file); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load() = %v, want %v", got, want)
+			}
+			// Save back and load again
+			if err := got.Save(file); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			got = cfg{}
+			if err := got.Load(file); err != nil {
+				t.Fatalf("Load() after Save() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load() after Save() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_cfg_Load_formats(t *testing.T) {
+	want := cfg{
+		ADDR:     "tcp://localhost:1883",
+		ClientID: "go-mli-test",
+		Connection: connectionOptions{
+			KeepAlive: duration(90 * time.Second),
+		},
+		Topics: []topic{
+			newTopic("demo"),
+			{Filter: "Sensor1/Temp", QoS: 0, Alias: "Temperature",
+				Enabled: true},
+		},
+	}
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    *cfg
+		wantErr bool
+	}{
+		{
+			name: "JSON",
+			file: "config.json",
+			content: `{"ADDR": "tcp://localhost:1883", "ClientID": "go-mli-test",
+				"Connection": {"KeepAlive": "1m30s"},
+				"Topics": ["demo", {"Filter": "Sensor1/Temp", "QoS": 0,
+					"Alias": "Temperature"}]}`,
+		},
+		{
+			name: "YAML",
+			file: "config.yaml",
+			content: `# Lab Broker
+ADDR: tcp://localhost:1883
+ClientID: go-mli-test
+Connection:
+  KeepAlive: 1m30s
+Topics:
+  - demo
+  # Room temperature for the climate study
+  - Filter: Sensor1/Temp
+    QoS: 0
+    Alias: Temperature
+`,
+		},
+		{
+			name: "TOML",
+			file: "config.toml",
+			content: `# Lab Broker
+ADDR = "tcp://localhost:1883"
+ClientID = "go-mli-test"
+Topics = [
+    "demo",
+    # Room temperature for the climate study
+    { Filter = "Sensor1/Temp", QoS = 0, Alias = "Temperature" },
+]
+
+[Connection]
+KeepAlive = "1m30s"
+`,
+		},
+		{
+			name: "YAML Plain Scalars",
+			file: "config.yml",
+			content: `ADDR: tcp://localhost:1883
+Username: true
+Password: 12345
+ClientID: 1001
+Connection: {KeepAlive: 1m30s}
+Topics:
+  - 100
+  - {Filter: Sensor1/Temp, QoS: 0, Alias: 2024}
+WebSocket:
+  Headers:
+    X-Api-Key: 0042
+`,
+			want: &cfg{
+				ADDR:     "tcp://localhost:1883",
+				Username: "true",
+				Password: "12345",
+				ClientID: "1001",
+				Connection: connectionOptions{
+					KeepAlive: duration(90 * time.Second),
+				},
+				Topics: []topic{
+					newTopic("100"),
+					{Filter: "Sensor1/Temp", QoS: 0, Alias: "2024",
+						Enabled: true},
+				},
+				WebSocket: websocketOptions{
+					Headers: map[string]string{"X-Api-Key": "0042"},
+				},
+			},
+		},
+		{
+			name:    "Negative Test - Invalid YAML",
+			file:    "config.yml",
+			content: "ADDR: [tcp://localhost:1883\n",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Invalid TOML",
+			file:    "config.toml",
+			content: "ADDR = tcp://localhost:1883\n",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Invalid Duration in YAML",
+			file:    "config.yaml",
+			content: "Connection:\n  KeepAlive: 90\n",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Text for Number in YAML",
+			file:    "config.yaml",
+			content: "Subscribe:\n  BatchSize: many\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write the file: %v", err)
+			}
+			var got cfg
+			err := got.Load(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			w := want
+			if tt.want != nil {
+				w = *tt.want
+			}
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("Load() = %v, want %v", got, w)
+			}
+		})
+	}
+}
+
+func Test_duration_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    duration
+		wantErr bool
+	}{
+		{
+			name: "Minutes and Seconds",
+			text: "1m30s",
+			want: duration(90 * time.Second),
+		},
+		{
+			name:    "Negative Test - Invalid Text",
+			text:    "ten seconds",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Negative Duration",
+			text:    "-5s",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d duration
+			err := d.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UnmarshalText() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if d != tt.want {
+				t.Errorf("UnmarshalText() = %v, want %v", d, tt.want)
+			}
+		})
+	}
+}
+
+func Test_topic_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []topic
+		wantErr bool
+	}{
+		{
+			name: "Plain Strings",
+			text: `["demo", "Sensor1/#"]`,
+			want: []topic{newTopic("demo"), newTopic("Sensor1/#")},
+		},
+		{
+			name: "Object Form",
+			text: `[{"filter": "Sensor1/Temp", "qos": 0, "alias": "Temp"},
+				{"filter": "alarm", "qos": 2, "enabled": false}]`,
+			want: []topic{
+				{Filter: "Sensor1/Temp", QoS: 0, Alias: "Temp", Enabled: true},
+				{Filter: "alarm", QoS: 2, Enabled: false},
+			},
+		},
+		{
+			name:    "Negative Test - Invalid QoS",
+			text:    `[{"filter": "demo", "qos": 3}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Invalid Retained Policy",
+			text:    `[{"filter": "demo", "retained": "keep"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Missing Filter",
+			text:    `[{"qos": 1}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []topic
+			err := json.Unmarshal([]byte(tt.text), &got)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UnmarshalJSON() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("UnmarshalJSON() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("UnmarshalJSON() [%d] = %v, want %v",
+						i, got[i], tt.want[i])
+				}
+			}
+			// Write back and read again
+			bs, err := json.Marshal(got)
+			if err != nil {
+				t.Fatalf("MarshalJSON() error = %v", err)
+			}
+			var again []topic
+			if err := json.Unmarshal(bs, &again); err != nil {
+				t.Fatalf("failed to read back %s: %v", bs, err)
+			}
+			for i := range again {
+				if again[i] != got[i] {
+					t.Errorf("round trip [%d] = %v, want %v",
+						i, again[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_cfg_sessions(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       cfg
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Single Broker",
+			m:    cfg{ADDR: "tcp://plant:1883"},
+			want: []string{""},
+		},
+		{
+			name: "Top Level and Sections",
+			m: cfg{
+				ADDR: "tcp://plant:1883",
+				Sections: []cfg{
+					{Name: "cloud", ADDR: "ssl://cloud:8883"},
+				},
+			},
+			want: []string{DEFAULT_SECTION, "cloud"},
+		},
+		{
+			name: "Only Sections",
+			m: cfg{
+				Sections: []cfg{
+					{Name: "plant", ADDR: "tcp://plant:1883"},
+					{Name: "cloud", ADDR: "ssl://cloud:8883"},
+				},
+			},
+			want: []string{"plant", "cloud"},
+		},
+		{
+			name: "Negative Test - Duplicate Names",
+			m: cfg{
+				Sections: []cfg{
+					{Name: "plant", ADDR: "tcp://plant:1883"},
+					{Name: "plant", ADDR: "ssl://cloud:8883"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Invalid Retained Policy",
+			m: cfg{
+				ADDR:     "tcp://plant:1883",
+				Retained: "keep",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Missing Name",
+			m: cfg{
+				Sections: []cfg{{ADDR: "tcp://plant:1883"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Top Level Columns and Instance ID",
+			m: cfg{
+				InstanceID: "site1",
+				Columns:    []string{"QoS"},
+				Sections: []cfg{
+					{Name: "plant", ADDR: "tcp://plant:1883"},
+				},
+			},
+			want: []string{"plant"},
+		},
+		{
+			name: "Negative Test - Columns in Section",
+			m: cfg{
+				Sections: []cfg{
+					{Name: "plant", ADDR: "tcp://plant:1883",
+						Columns: []string{"QoS"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Instance ID in Section",
+			m: cfg{
+				Sections: []cfg{
+					{Name: "plant", ADDR: "tcp://plant:1883",
+						InstanceID: "site1"},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.m.sessions()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sessions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("sessions() = %d sessions, want %d",
+					len(got), len(tt.want))
+			}
+			for i, s := range got {
+				if s.Name != tt.want[i] {
+					t.Errorf("sessions() [%d] = %q, want %q",
+						i, s.Name, tt.want[i])
+				}
+				if len(s.Sections) > 0 {
+					t.Errorf("sessions() [%d] has nested sections", i)
+				}
+			}
+		})
+	}
+}
+
+func Test_cfg_subscribeTopics(t *testing.T) {
+	m := cfg{
+		SharedGroup: "loggers",
+		Topics: []topic{
+			newTopic("Sensor1/#"),
+			{Filter: "alarm", QoS: 2, Alias: "Alarm", Enabled: true},
+		},
+	}
+	want := []topic{
+		{Filter: "$share/loggers/Sensor1/#", QoS: 1, Enabled: true},
+		{Filter: "$share/loggers/alarm", QoS: 2, Alias: "Alarm",
+			Enabled: true},
+	}
+	got := m.subscribeTopics()
+	if len(got) != len(want) {
+		t.Fatalf("subscribeTopics() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("subscribeTopics() [%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	// Global retained policy
+	m.Retained = RETAINED_DROP
+	m.Topics[1].Retained = RETAINED_MARK
+	got = m.subscribeTopics()
+	if got[0].Retained != RETAINED_DROP || got[1].Retained != RETAINED_MARK {
+		t.Errorf("subscribeTopics() failed to apply retained policy: %v", got)
+	}
+	// Broker statistics
+	m.SysStats = true
+	got = m.subscribeTopics()
+	if len(got) != 3 || got[2].Filter != SYS_TOPIC ||
+		got[2].Retained != RETAINED_RECORD {
+		t.Errorf("subscribeTopics() failed to add the $SYS topic: %v", got)
+	}
+	// Original topics are unchanged
+	if m.Topics[0].Filter != "Sensor1/#" {
+		t.Errorf("subscribeTopics() changed the topics: %v", m.Topics)
+	}
+}
+
+func Test_expandClientID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("failed to get hostname: %v", err)
+	}
+	tests := []struct {
+		name    string
+		id      string
+		want    string
+		pattern string
+		wantErr bool
+	}{
+		{
+			name: "No Placeholders",
+			id:   "go-mli-demo",
+			want: "go-mli-demo",
+		},
+		{
+			name: "Hostname and PID",
+			id:   "go-mli-{hostname}-{pid}",
+			want: "go-mli-" + hostname + "-" + strconv.Itoa(os.Getpid()),
+		},
+		{
+			name:    "Random",
+			id:      "go-mli-{rand:8}",
+			pattern: "^go-mli-[0-9a-f]{8}$",
+		},
+		{
+			name:    "Random Odd Length",
+			id:      "{rand:3}",
+			pattern: "^[0-9a-f]{3}$",
+		},
+		{
+			name:    "User",
+			id:      "go-mli-{user}",
+			pattern: `^go-mli-[^{}\\]+$`,
+		},
+		{
+			name:    "Negative Test - Unknown Placeholder",
+			id:      "go-mli-{host}",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Random without Length",
+			id:      "go-mli-{rand}",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Random too Long",
+			id:      "go-mli-{rand:33}",
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Length for Hostname",
+			id:      "go-mli-{hostname:4}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandClientID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandClientID() error = %v, wantErr %v",
+					err, tt.wantErr)
+			}
+			if len(tt.pattern) > 0 {
+				if !regexp.MustCompile(tt.pattern).MatchString(got) {
+					t.Errorf("expandClientID() = %q, want match %q",
+						got, tt.pattern)
+				}
+			} else if got != tt.want {
+				t.Errorf("expandClientID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
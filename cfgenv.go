@@ -0,0 +1,349 @@
+// cfgenv.go - Configuration from Environment Variables
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Configuration from Environment Variables
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Prefix of the environment variables overriding the configuration
+	ENV_PREFIX = "MLI_"
+)
+
+// envReference matches "${VAR}" and "${VAR:-default}" in the string
+// values, and "$${" to keep a literal "${". The plain "$VAR" form is left
+// alone as MQTT topics such as "$SYS/#" start with "$".
+var envReference = regexp.MustCompile(
+	`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// cfgSource tells where the value of a configuration field came from when
+// not taken as is from the file.
+type cfgSource struct {
+	// Field path such as "Password" or "Sections[0].Topics[1].Filter"
+	Field string
+	// Origin such as "${MQTT_PASSWORD}" or "$MLI_ADDR"
+	Origin string
+	// keys of the field path, the names and the indexes
+	keys []any
+	// raw value in the file written back by Save, nil when absent
+	raw json.RawMessage
+}
+
+// envOverrides are the top level fields that can be overridden by the
+// environment variable ENV_PREFIX followed by the upper case field name,
+// e.g. "MLI_ADDR". Lists are separated by commas.
+var envOverrides = []struct {
+	field string
+	set   func(m *cfg, v string) error
+}{
+	{"Name", func(m *cfg, v string) error { m.Name = v; return nil }},
+	{"ADDR", func(m *cfg, v string) error { m.ADDR = v; return nil }},
+	{"Brokers", func(m *cfg, v string) error {
+		m.Brokers = splitEnvList(v)
+		return nil
+	}},
+	{"Username", func(m *cfg, v string) error { m.Username = v; return nil }},
+	{"Password", func(m *cfg, v string) error { m.Password = v; return nil }},
+	{"CAFile", func(m *cfg, v string) error { m.CAFile = v; return nil }},
+	{"ClientID", func(m *cfg, v string) error { m.ClientID = v; return nil }},
+	{"ClientCertFile", func(m *cfg, v string) error {
+		m.ClientCertFile = v
+		return nil
+	}},
+	{"ClientKeyFile", func(m *cfg, v string) error {
+		m.ClientKeyFile = v
+		return nil
+	}},
+	{"Topics", func(m *cfg, v string) error {
+		m.Topics = nil
+		for _, f := range splitEnvList(v) {
+			m.Topics = append(m.Topics, newTopic(f))
+		}
+		return nil
+	}},
+	{"SharedGroup", func(m *cfg, v string) error {
+		m.SharedGroup = v
+		return nil
+	}},
+	{"InstanceID", func(m *cfg, v string) error {
+		m.InstanceID = v
+		return nil
+	}},
+	{"Retained", func(m *cfg, v string) error { m.Retained = v; return nil }},
+	{"ProtocolVersion", func(m *cfg, v string) error {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid protocol version %q", v)
+		}
+		m.ProtocolVersion = byte(n)
+		return nil
+	}},
+}
+
+// splitEnvList splits the comma separated list skipping empty items.
+func splitEnvList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) > 0 {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// expandEnv replaces the environment variable references in the string.
+// It returns the origin of the value if any reference was found. A
+// variable that is not set is an error unless it has a default, which is
+// also used when the variable is empty.
+func expandEnv(s string) (string, string, error) {
+	var origins []string
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		sm := envReference.FindStringSubmatch(ref)
+		name, hasDefault, def := sm[1], len(sm[2]) > 0, sm[3]
+		v, ok := os.LookupEnv(name)
+		switch {
+		case ok && (len(v) > 0 || !hasDefault):
+			origins = append(origins, "${"+name+"}")
+			return v
+		case hasDefault:
+			origins = append(origins, "default of ${"+name+"}")
+			return def
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return ""
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return expanded, strings.Join(origins, " and "), nil
+}
+
+// expandCfgEnv replaces the environment variable references in all the
+// string values of the JSON configuration, noting their sources.
+func expandCfgEnv(bs []byte, sources *[]cfgSource) ([]byte, error) {
+	var v any
+	d := json.NewDecoder(bytes.NewReader(bs))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v, err := expandEnvValues(v, "", nil, sources)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(*sources, func(i, j int) bool {
+		return (*sources)[i].Field < (*sources)[j].Field
+	})
+	return json.Marshal(v)
+}
+
+// expandEnvValues walks through the decoded JSON value at the path and
+// expands the strings.
+func expandEnvValues(v any, path string, keys []any,
+	sources *[]cfgSource) (any, error) {
+	switch t := v.(type) {
+	case string:
+		s, origin, err := expandEnv(t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand %q:\n %v", path, err)
+		}
+		if len(origin) > 0 {
+			raw, _ := json.Marshal(t)
+			*sources = append(*sources, cfgSource{path, origin,
+				slices.Clone(keys), raw})
+		}
+		return s, nil
+	case map[string]any:
+		for k, e := range t {
+			p := k
+			if len(path) > 0 {
+				p = path + "." + k
+			}
+			r, err := expandEnvValues(e, p, append(keys, k), sources)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = r
+		}
+	case []any:
+		for i, e := range t {
+			r, err := expandEnvValues(e, fmt.Sprintf("%s[%d]", path, i),
+				append(keys, i), sources)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = r
+		}
+	}
+	return v, nil
+}
+
+// restoreCfgEnv writes back the values of the JSON configuration that came
+// from the environment as they were in the file, such that saving the
+// configuration does not reveal them.
+func restoreCfgEnv(bs []byte, sources []cfgSource) ([]byte, error) {
+	var v any
+	d := json.NewDecoder(bytes.NewReader(bs))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		v = setJSONValue(v, s.keys, s.raw)
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
+
+// setJSONValue sets the raw value at the keys in the decoded JSON value,
+// removing the field for a nil raw value. The names match regardless of
+// case like JSON does.
+func setJSONValue(v any, keys []any, raw json.RawMessage) any {
+	if len(keys) == 0 {
+		return raw
+	}
+	switch k := keys[0].(type) {
+	case int:
+		if a, ok := v.([]any); ok && k < len(a) {
+			a[k] = setJSONValue(a[k], keys[1:], raw)
+		}
+	case string:
+		if filter, ok := v.(string); ok {
+			// Topic with default options written as the plain filter
+			v = map[string]any{"Filter": filter}
+		}
+		o, ok := v.(map[string]any)
+		if !ok {
+			break
+		}
+		name := k
+		if _, ok := o[k]; !ok {
+			for n := range o {
+				if strings.EqualFold(n, k) {
+					name = n
+				}
+			}
+		}
+		if raw == nil && len(keys) == 1 {
+			delete(o, name)
+			break
+		}
+		o[name] = setJSONValue(o[name], keys[1:], raw)
+	}
+	return v
+}
+
+// applyEnvOverrides sets the top level fields from the environment
+// variables, replacing the sources of the overridden fields. The fields
+// as in the file, before any expansion, are needed to write them back.
+func (m *cfg) applyEnvOverrides(file map[string]json.RawMessage) error {
+	for _, o := range envOverrides {
+		name := ENV_PREFIX + strings.ToUpper(o.field)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := o.set(m, v); err != nil {
+			return fmt.Errorf("failed to apply %q:\n %v", name, err)
+		}
+		// Drop the sources of the replaced values
+		sources := m.sources[:0]
+		for _, s := range m.sources {
+			if !isFieldPath(s.Field, o.field) {
+				sources = append(sources, s)
+			}
+		}
+		var raw json.RawMessage
+		for k, v := range file {
+			if strings.EqualFold(k, o.field) {
+				raw = v
+			}
+		}
+		m.sources = append(sources, cfgSource{o.field, "$" + name,
+			[]any{o.field}, raw})
+	}
+	return nil
+}
+
+// isFieldPath tells if the path refers to the field or a part of it. The
+// field names in the file are matched regardless of case like JSON does.
+func isFieldPath(path, field string) bool {
+	if len(path) < len(field) || !strings.EqualFold(path[:len(field)], field) {
+		return false
+	}
+	rest := path[len(field):]
+	return len(rest) == 0 || rest[0] == '.' || rest[0] == '['
+}
+
+// sourcesString describes where the configuration values came from for
+// the configuration file.
+func (m cfg) sourcesString(Filename string) string {
+	if len(m.sources) == 0 {
+		return fmt.Sprintf("all from %q", Filename)
+	}
+	list := make([]string, 0, len(m.sources))
+	for _, s := range m.sources {
+		list = append(list, s.Field+" from "+s.Origin)
+	}
+	return fmt.Sprintf("from %q except %s", Filename,
+		strings.Join(list, ", "))
+}
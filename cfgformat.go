@@ -0,0 +1,384 @@
+// cfgformat.go - Configuration File Formats
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Configuration File Formats
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Supported configuration file formats
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+// tomlBareKey matches the TOML keys that need no quotes.
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// cfgFormat returns the format of the configuration file by its
+// extension, JSON for any unknown extension.
+func cfgFormat(Filename string) string {
+	switch strings.ToLower(filepath.Ext(Filename)) {
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	case ".toml":
+		return FORMAT_TOML
+	}
+	return FORMAT_JSON
+}
+
+// decodeCfg converts the configuration in the given format to JSON, such
+// that all the formats are processed by the same JSON decoding.
+func decodeCfg(format string, bs []byte) ([]byte, error) {
+	var v any
+	switch format {
+	case FORMAT_YAML:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(bs, &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			// Empty document
+			return []byte("{}"), nil
+		}
+		var err error
+		v, err = yamlValue(doc.Content[0], reflect.TypeOf(cfg{}))
+		if err != nil {
+			return nil, err
+		}
+	case FORMAT_TOML:
+		t := map[string]any{}
+		if err := toml.Unmarshal(bs, &t); err != nil {
+			return nil, err
+		}
+		v = t
+	default:
+		return bs, nil
+	}
+	return json.Marshal(v)
+}
+
+// yamlValue converts the YAML node to the value for JSON encoding as per
+// the type of the configuration field. Plain scalars such as 12345 or
+// true stay strings for the string fields, like "Password: 12345", as
+// YAML does not need quotes for them unlike JSON.
+func yamlValue(n *yaml.Node, t reflect.Type) (any, error) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if t != nil && n.ShortTag() != "!!null" && isTextType(t) {
+			return n.Value, nil
+		}
+	case yaml.MappingNode:
+		if t == nil || (t.Kind() != reflect.Struct && t.Kind() != reflect.Map) {
+			break
+		}
+		v := make(map[string]any, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			var ft reflect.Type
+			if t.Kind() == reflect.Map {
+				ft = t.Elem()
+			} else if f, ok := jsonField(t, k); ok {
+				ft = f.Type
+			}
+			e, err := yamlValue(n.Content[i+1], ft)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = e
+		}
+		return v, nil
+	case yaml.SequenceNode:
+		if t == nil || (t.Kind() != reflect.Slice && t.Kind() != reflect.Array) {
+			break
+		}
+		v := make([]any, 0, len(n.Content))
+		for _, c := range n.Content {
+			e, err := yamlValue(c, t.Elem())
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, e)
+		}
+		return v, nil
+	}
+	// Unknown fields and the other types as decoded by YAML
+	var v any
+	if err := n.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// isTextType tells if the values of the type are given as strings, which
+// includes the types decoding themselves such as duration and topic.
+func isTextType(t reflect.Type) bool {
+	p := reflect.PointerTo(t)
+	return t.Kind() == reflect.String ||
+		p.Implements(reflect.TypeFor[encoding.TextUnmarshaler]()) ||
+		p.Implements(reflect.TypeFor[json.Unmarshaler]())
+}
+
+// jsonField finds the exported struct field for the key, preferring an
+// exact match over a case insensitive one like JSON does.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	if f, ok := t.FieldByName(key); ok && f.IsExported() {
+		return f, true
+	}
+	return t.FieldByNameFunc(func(name string) bool {
+		f, _ := t.FieldByName(name)
+		return f.IsExported() && strings.EqualFold(name, key)
+	})
+}
+
+// encodeCfg converts the JSON configuration to the given format. The
+// comments are keyed by the dotted path of the field such as
+// "Connection.KeepAlive" with "" for the whole file. JSON has no
+// comments, hence they are only written for YAML and TOML.
+func encodeCfg(format string, bs []byte,
+	comments map[string]string) ([]byte, error) {
+	if format == FORMAT_JSON {
+		return bs, nil
+	}
+	// JSON is valid YAML and keeps the order of the fields
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("empty configuration")
+	}
+	prepareNode(doc.Content[0], "", comments)
+	doc.HeadComment = comments[""]
+
+	if format == FORMAT_TOML {
+		var b bytes.Buffer
+		writeTOMLComment(&b, doc.HeadComment)
+		if len(doc.HeadComment) > 0 {
+			b.WriteString("\n")
+		}
+		writeTOMLTable(&b, nil, doc.Content[0])
+		return b.Bytes(), nil
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// prepareNode switches the node parsed from JSON to the block style,
+// drops the null fields absent in TOML and attaches the comments.
+func prepareNode(n *yaml.Node, path string, comments map[string]string) {
+	n.Style = 0
+	switch n.Kind {
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			prepareNode(c, "", nil)
+		}
+	case yaml.MappingNode:
+		var content []*yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if v.ShortTag() == "!!null" {
+				continue
+			}
+			p := k.Value
+			if len(path) > 0 {
+				p = path + "." + k.Value
+			}
+			k.Style = 0
+			k.HeadComment = comments[p]
+			prepareNode(v, p, comments)
+			content = append(content, k, v)
+		}
+		n.Content = content
+	}
+}
+
+// isTOMLTable tells if the value is written as a TOML table or an array of
+// tables instead of an inline value.
+func isTOMLTable(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return true
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			if c.Kind != yaml.MappingNode {
+				return false
+			}
+		}
+		return len(n.Content) > 0
+	}
+	return false
+}
+
+// hasTOMLInlineTable tells if any item of the array is an inline table.
+func hasTOMLInlineTable(n *yaml.Node) bool {
+	for _, c := range n.Content {
+		if c.Kind == yaml.MappingNode {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTOMLTable writes the plain values of the mapping followed by its
+// tables, as TOML needs all the values of a table before the next header.
+func writeTOMLTable(b *bytes.Buffer, path []string, n *yaml.Node) {
+	var tables []int
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if isTOMLTable(v) {
+			tables = append(tables, i)
+			continue
+		}
+		writeTOMLComment(b, k.HeadComment)
+		if v.Kind == yaml.SequenceNode && hasTOMLInlineTable(v) {
+			// One item per line as inline tables can get long
+			fmt.Fprintf(b, "%s = [\n", tomlKey(k.Value))
+			for _, c := range v.Content {
+				fmt.Fprintf(b, "    %s,\n", tomlValue(c))
+			}
+			b.WriteString("]\n")
+			continue
+		}
+		fmt.Fprintf(b, "%s = %s\n", tomlKey(k.Value), tomlValue(v))
+	}
+	for _, i := range tables {
+		k, v := n.Content[i], n.Content[i+1]
+		p := append(append([]string{}, path...), tomlKey(k.Value))
+		header := strings.Join(p, ".")
+		b.WriteString("\n")
+		writeTOMLComment(b, k.HeadComment)
+		if v.Kind == yaml.MappingNode {
+			fmt.Fprintf(b, "[%s]\n", header)
+			writeTOMLTable(b, p, v)
+			continue
+		}
+		for j, c := range v.Content {
+			if j > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(b, "[[%s]]\n", header)
+			writeTOMLTable(b, p, c)
+		}
+	}
+}
+
+// writeTOMLComment writes each line of the comment prefixed with "# ".
+func writeTOMLComment(b *bytes.Buffer, comment string) {
+	if len(comment) == 0 {
+		return
+	}
+	for _, line := range strings.Split(comment, "\n") {
+		fmt.Fprintf(b, "# %s\n", line)
+	}
+}
+
+// tomlKey quotes the key if needed.
+func tomlKey(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+// tomlString quotes the string, the JSON escapes being valid in TOML.
+func tomlString(s string) string {
+	bs, _ := json.Marshal(s)
+	return string(bs)
+}
+
+// tomlValue returns the inline TOML form of the value.
+func tomlValue(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(n.Content))
+		for _, c := range n.Content {
+			items = append(items, tomlValue(c))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case yaml.MappingNode:
+		items := make([]string, 0, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			items = append(items, tomlKey(n.Content[i].Value)+" = "+
+				tomlValue(n.Content[i+1]))
+		}
+		if len(items) == 0 {
+			return "{}"
+		}
+		return "{ " + strings.Join(items, ", ") + " }"
+	}
+	if n.ShortTag() == "!!str" {
+		return tomlString(n.Value)
+	}
+	// Numbers and booleans as written by JSON
+	return n.Value
+}
@@ -0,0 +1,326 @@
+// control.go - Runtime Control
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Runtime Control
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Commands accepted on the control topic
+	CONTROL_SUBSCRIBE   = "subscribe"
+	CONTROL_UNSUBSCRIBE = "unsubscribe"
+	CONTROL_PAUSE       = "pause"
+	CONTROL_RESUME      = "resume"
+	CONTROL_ROTATE      = "rotate"
+	CONTROL_ANNOTATE    = "annotate"
+	// Suffix of the default response topic
+	CONTROL_RESPONSE_SUFFIX = "/response"
+	// Time to wait for the Broker or the storage to act on a command
+	CONTROL_TIMEOUT = 5 * time.Second
+)
+
+// controlCommand is the JSON command received on the control topic.
+type controlCommand struct {
+	// ID is returned in the response to match the command.
+	ID      string
+	Command string
+	Token   string
+	// Topic filter with its QoS and Alias for subscribe and unsubscribe.
+	// Without QoS the topic gets the default TOPIC_QOS.
+	Topic string
+	QoS   *byte
+	Alias string
+	// Text for annotate.
+	Text string
+}
+
+// controlResponse is the JSON reply published on the response topic.
+type controlResponse struct {
+	ID      string
+	Command string
+	OK      bool
+	Error   string
+	Result  string
+	Time    time.Time
+}
+
+// controller executes the commands received on the control topic, and
+// keeps track of the topics changed at runtime so that they survive
+// reconnections.
+type controller struct {
+	m        cfg
+	topic    string
+	response string
+	rotate   func() (string, error)
+	rec      recorderFn
+	dispatch *dispatcher
+	paused   atomic.Bool
+	mu       sync.Mutex
+	added    map[string]topic
+	removed  map[string]bool
+}
+
+// newController creates the controller for the supplied configuration,
+// with the function to rotate the log files.
+func newController(m cfg, rotate func() (string, error)) *controller {
+	c := &controller{
+		m:       m,
+		topic:   strings.ReplaceAll(m.Control.Topic, "{clientid}", m.ClientID),
+		rotate:  rotate,
+		added:   make(map[string]topic),
+		removed: make(map[string]bool),
+	}
+	c.response = m.Control.ResponseTopic
+	if len(c.response) == 0 && c.enabled() {
+		c.response = c.topic + CONTROL_RESPONSE_SUFFIX
+	}
+	c.response = strings.ReplaceAll(c.response, "{clientid}", m.ClientID)
+	return c
+}
+
+// enabled reports if the control topic is configured.
+func (c *controller) enabled() bool {
+	return len(c.topic) > 0
+}
+
+// recorder wraps the recorder to leave out the messages received while
+// paused, along with the commands and replies in case a wildcard topic
+// covers them. The records of the logger itself are kept.
+func (c *controller) recorder(rec recorderFn) recorderFn {
+	return func(s1, s2 string, meta *msgMeta) {
+		if meta != nil && (c.paused.Load() ||
+			(c.enabled() && (s1 == c.topic || s1 == c.response))) {
+			return
+		}
+		rec(s1, s2, meta)
+	}
+}
+
+// setup validates the control settings and registers the subscription
+// to the control topic on every connection into the supplied MQTT
+// options. The topics changed at runtime are restored on reconnection,
+// and passed on to the dispatcher of the received messages.
+func (c *controller) setup(opts *mqtt.ClientOptions, d *dispatcher) error {
+	if !c.enabled() {
+		return nil
+	}
+	if len(c.m.Control.Token) == 0 {
+		return fmt.Errorf("control topic %q needs a token", c.topic)
+	}
+	if c.m.Control.QoS > 2 {
+		return fmt.Errorf("invalid qos %d for control topic %q",
+			c.m.Control.QoS, c.topic)
+	}
+	c.rec = d.rec
+	c.dispatch = d
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if onConnect != nil {
+			onConnect(client)
+		}
+		c.restore(client)
+		token := client.Subscribe(c.topic, c.m.Control.QoS,
+			func(client mqtt.Client, msg mqtt.Message) {
+				// Commands wait for the Broker, so not in the handler
+				go c.handle(client, msg.Payload(), msg.Retained())
+			})
+		if !token.WaitTimeout(CONTROL_TIMEOUT) || token.Error() != nil {
+			log.Printf("[Control][ERROR] Failed to subscribe to %q: %v\n",
+				c.topic, token.Error())
+			return
+		}
+		log.Printf("[Control] Listening for commands on %q\n", c.topic)
+	})
+	return nil
+}
+
+// restore applies the topics changed at runtime after a reconnection.
+func (c *controller) restore(client mqtt.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.added {
+		if err := subscribeMQTT(client, t); err != nil {
+			log.Printf("[Control][ERROR] Failed to resubscribe to %q\n %v\n",
+				t.Filter, err)
+		}
+	}
+	for filter := range c.removed {
+		if err := c.unsubscribe(client, filter); err != nil {
+			log.Printf("[Control][ERROR] Failed to unsubscribe from %q\n %v\n",
+				filter, err)
+		}
+	}
+}
+
+// handle processes the supplied command payload and publishes the reply.
+// Retained commands are refused, else they would run again on every
+// subscription to the control topic.
+func (c *controller) handle(client mqtt.Client, payload []byte,
+	retained bool) {
+	var cmd controlCommand
+	res := controlResponse{}
+	err := json.Unmarshal(payload, &cmd)
+	if err != nil {
+		err = fmt.Errorf("invalid command: %v", err)
+	} else if retained {
+		err = fmt.Errorf("retained command ignored")
+	} else if subtle.ConstantTimeCompare([]byte(cmd.Token),
+		[]byte(c.m.Control.Token)) != 1 {
+		err = fmt.Errorf("invalid token")
+	} else {
+		res.Result, err = c.execute(client, cmd)
+	}
+	res.ID = cmd.ID
+	res.Command = cmd.Command
+	res.OK = err == nil
+	res.Time = time.Now()
+	if err != nil {
+		res.Error = err.Error()
+		log.Printf("[Control][ERROR] Command %q failed: %v\n", cmd.Command, err)
+	} else {
+		log.Printf("[Control] Command %q done %s\n", cmd.Command, res.Result)
+	}
+	bs, _ := json.Marshal(res)
+	token := client.Publish(c.response, c.m.Control.QoS, false, bs)
+	if !token.WaitTimeout(CONTROL_TIMEOUT) || token.Error() != nil {
+		log.Printf("[Control][ERROR] Failed to reply on %q: %v\n",
+			c.response, token.Error())
+	}
+}
+
+// execute performs the supplied command and returns its result.
+func (c *controller) execute(client mqtt.Client, cmd controlCommand) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cmd.Command {
+	case CONTROL_SUBSCRIBE, CONTROL_UNSUBSCRIBE:
+		if len(cmd.Topic) == 0 {
+			return "", fmt.Errorf("missing topic")
+		}
+		// Same shared group and retained policy as the configured topics
+		t := newTopic(cmd.Topic)
+		if cmd.QoS != nil {
+			if *cmd.QoS > 2 {
+				return "", fmt.Errorf("invalid qos %d for %q",
+					*cmd.QoS, cmd.Topic)
+			}
+			t.QoS = *cmd.QoS
+		}
+		t.Alias = cmd.Alias
+		t = cfg{
+			SharedGroup: c.m.SharedGroup,
+			Retained:    c.m.Retained,
+			Topics:      []topic{t},
+		}.subscribeTopics()[0]
+		if cmd.Command == CONTROL_UNSUBSCRIBE {
+			if err := c.unsubscribe(client, t.Filter); err != nil {
+				return "", err
+			}
+			c.dispatch.remove(t.Filter)
+			delete(c.added, t.Filter)
+			c.removed[t.Filter] = true
+			c.rec(MARKER_TOPIC, "unsubscribed: "+t.Filter, nil)
+			return t.Filter, nil
+		}
+		if err := subscribeMQTT(client, t); err != nil {
+			return "", err
+		}
+		c.dispatch.add(t)
+		delete(c.removed, t.Filter)
+		c.added[t.Filter] = t
+		c.rec(MARKER_TOPIC, "subscribed: "+t.Filter, nil)
+		return t.Filter, nil
+
+	case CONTROL_PAUSE:
+		c.paused.Store(true)
+		c.rec(MARKER_TOPIC, "paused", nil)
+		return "", nil
+
+	case CONTROL_RESUME:
+		c.paused.Store(false)
+		c.rec(MARKER_TOPIC, "resumed", nil)
+		return "", nil
+
+	case CONTROL_ROTATE:
+		if c.rotate == nil {
+			return "", fmt.Errorf("rotation not available")
+		}
+		c.rec(MARKER_TOPIC, "rotating", nil)
+		return c.rotate()
+
+	case CONTROL_ANNOTATE:
+		if len(cmd.Text) == 0 {
+			return "", fmt.Errorf("missing text")
+		}
+		c.rec(MARKER_TOPIC, "annotation: "+cmd.Text, nil)
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %q", cmd.Command)
+}
+
+// unsubscribe removes the subscription of the supplied topic filter.
+func (c *controller) unsubscribe(client mqtt.Client, filter string) error {
+	token := client.Unsubscribe(filter)
+	if !token.WaitTimeout(CONTROL_TIMEOUT) {
+		return fmt.Errorf("timeout unsubscribing from %q", filter)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("failed to unsubscribe from %q:\n %v",
+			filter, token.Error())
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+// control_test.go - Runtime Control Tests
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Runtime Control - Tests
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testToken is a completed token with the supplied error.
+type testToken struct {
+	err error
+}
+
+func (t *testToken) Wait() bool                     { return true }
+func (t *testToken) WaitTimeout(time.Duration) bool { return true }
+func (t *testToken) Error() error                   { return t.err }
+func (t *testToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// testClient is a MQTT client that notes the subscriptions and the
+// published messages without any Broker.
+type testClient struct {
+	mu           sync.Mutex
+	subscribed   []string
+	unsubscribed []string
+	published    map[string][]byte
+	handlers     map[string]mqtt.MessageHandler
+	// batches are the filters of each SubscribeMultiple call
+	batches []map[string]byte
+	// failFilter fails the SubscribeMultiple call containing it
+	failFilter string
+}
+
+func newTestClient() *testClient {
+	return &testClient{
+		published: make(map[string][]byte),
+		handlers:  make(map[string]mqtt.MessageHandler),
+	}
+}
+
+func (c *testClient) IsConnected() bool      { return true }
+func (c *testClient) IsConnectionOpen() bool { return true }
+func (c *testClient) Connect() mqtt.Token    { return &testToken{} }
+func (c *testClient) Disconnect(uint)        {}
+func (c *testClient) Publish(topic string, qos byte, retained bool,
+	payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published[topic] = payload.([]byte)
+	return &testToken{}
+}
+func (c *testClient) Subscribe(topic string, qos byte,
+	callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = append(c.subscribed, topic)
+	c.handlers[topic] = callback
+	return &testToken{}
+}
+func (c *testClient) SubscribeMultiple(filters map[string]byte,
+	callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches = append(c.batches, filters)
+	if _, ok := filters[c.failFilter]; ok {
+		return &testToken{err: fmt.Errorf("subscribe timed out")}
+	}
+	for f := range filters {
+		c.subscribed = append(c.subscribed, f)
+	}
+	return &testToken{}
+}
+func (c *testClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return &testToken{}
+}
+func (c *testClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+func (c *testClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+func Test_controller_setup(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       cfg
+		wantErr bool
+	}{
+		{
+			name: "Control Disabled",
+			m:    cfg{ClientID: "go-mli-control-test"},
+		},
+		{
+			name: "Control Topic",
+			m: cfg{
+				ClientID: "go-mli-control-test",
+				Control: controlOptions{
+					Topic: "go-mli/{clientid}/control",
+					Token: "secret",
+				},
+			},
+		},
+		{
+			name: "Negative Test - Missing Token",
+			m: cfg{
+				Control: controlOptions{Topic: "go-mli/control"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Invalid QoS",
+			m: cfg{
+				Control: controlOptions{
+					Topic: "go-mli/control",
+					Token: "secret",
+					QoS:   3,
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := mqtt.NewClientOptions()
+			c := newController(tt.m, nil)
+			err := c.setup(opts, newDispatcher(tt.m, dummyRecorderFn(t)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr || !c.enabled() {
+				return
+			}
+			if c.topic != "go-mli/go-mli-control-test/control" ||
+				c.response != c.topic+CONTROL_RESPONSE_SUFFIX {
+				t.Errorf("failed to get correct topics: %q, %q",
+					c.topic, c.response)
+			}
+			client := newTestClient()
+			opts.OnConnect(client)
+			if len(client.subscribed) != 1 || client.subscribed[0] != c.topic {
+				t.Errorf("failed to subscribe to the control topic: %v",
+					client.subscribed)
+			}
+		})
+	}
+}
+
+func Test_controller_handle(t *testing.T) {
+	qos := func(q byte) *byte { return &q }
+	tests := []struct {
+		name       string
+		m          cfg
+		cmd        controlCommand
+		retained   bool
+		wantOK     bool
+		wantResult string
+		checkFn    func(t *testing.T, c *controller, client *testClient)
+	}{
+		{
+			name: "Subscribe",
+			cmd: controlCommand{ID: "1", Command: CONTROL_SUBSCRIBE,
+				Token: "secret", Topic: "demo/#", QoS: qos(0)},
+			wantOK:     true,
+			wantResult: "demo/#",
+			checkFn: func(t *testing.T, c *controller, client *testClient) {
+				if len(client.subscribed) != 1 ||
+					client.subscribed[0] != "demo/#" {
+					t.Errorf("failed to subscribe: %v", client.subscribed)
+				}
+				if q, ok := client.batches[0]["demo/#"]; !ok || q != 0 {
+					t.Errorf("failed to subscribe with QoS 0: %v",
+						client.batches)
+				}
+				if _, ok := c.added["demo/#"]; !ok {
+					t.Errorf("failed to note the added topic")
+				}
+			},
+		},
+		{
+			name: "Subscribe with Shared Group",
+			m:    cfg{SharedGroup: "loggers"},
+			cmd: controlCommand{ID: "2", Command: CONTROL_SUBSCRIBE,
+				Token: "secret", Topic: "demo/#"},
+			wantOK:     true,
+			wantResult: "$share/loggers/demo/#",
+			checkFn: func(t *testing.T, c *controller, client *testClient) {
+				q, ok := client.batches[0]["$share/loggers/demo/#"]
+				if !ok || q != TOPIC_QOS {
+					t.Errorf("failed to subscribe with the default QoS: %v",
+						client.batches)
+				}
+			},
+		},
+		{
+			name: "Unsubscribe",
+			cmd: controlCommand{ID: "3", Command: CONTROL_UNSUBSCRIBE,
+				Token: "secret", Topic: "demo/#"},
+			wantOK:     true,
+			wantResult: "demo/#",
+			checkFn: func(t *testing.T, c *controller, client *testClient) {
+				if len(client.unsubscribed) != 1 || !c.removed["demo/#"] {
+					t.Errorf("failed to unsubscribe: %v", client.unsubscribed)
+				}
+			},
+		},
+		{
+			name:   "Pause",
+			cmd:    controlCommand{Command: CONTROL_PAUSE, Token: "secret"},
+			wantOK: true,
+			checkFn: func(t *testing.T, c *controller, client *testClient) {
+				if !c.paused.Load() {
+					t.Errorf("failed to pause")
+				}
+			},
+		},
+		{
+			name:       "Rotate",
+			cmd:        controlCommand{Command: CONTROL_ROTATE, Token: "secret"},
+			wantOK:     true,
+			wantResult: "log-test.csv",
+		},
+		{
+			name: "Annotate",
+			cmd: controlCommand{Command: CONTROL_ANNOTATE, Token: "secret",
+				Text: "valve opened"},
+			wantOK: true,
+		},
+		{
+			name: "Negative Test - Invalid Token",
+			cmd:  controlCommand{Command: CONTROL_PAUSE, Token: "guess"},
+		},
+		{
+			name: "Negative Test - Unknown Command",
+			cmd:  controlCommand{Command: "restart", Token: "secret"},
+		},
+		{
+			name: "Negative Test - Invalid QoS",
+			cmd: controlCommand{Command: CONTROL_SUBSCRIBE, Token: "secret",
+				Topic: "demo/#", QoS: qos(3)},
+		},
+		{
+			name: "Negative Test - Missing Topic",
+			cmd:  controlCommand{Command: CONTROL_SUBSCRIBE, Token: "secret"},
+		},
+		{
+			name: "Negative Test - Missing Text",
+			cmd:  controlCommand{Command: CONTROL_ANNOTATE, Token: "secret"},
+		},
+		{
+			name:     "Negative Test - Retained Command",
+			cmd:      controlCommand{Command: CONTROL_PAUSE, Token: "secret"},
+			retained: true,
+			checkFn: func(t *testing.T, c *controller, client *testClient) {
+				if c.paused.Load() {
+					t.Errorf("failed to ignore the retained command")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Control = controlOptions{
+				Topic: "go-mli/control",
+				Token: "secret",
+			}
+			c := newController(tt.m, func() (string, error) {
+				return "log-test.csv", nil
+			})
+			if err := c.setup(mqtt.NewClientOptions(),
+				newDispatcher(tt.m, dummyRecorderFn(t))); err != nil {
+				t.Fatalf("setup() error = %v", err)
+			}
+			client := newTestClient()
+			payload, _ := json.Marshal(tt.cmd)
+			c.handle(client, payload, tt.retained)
+
+			var res controlResponse
+			err := json.Unmarshal(client.published[c.response], &res)
+			if err != nil {
+				t.Fatalf("failed to decode the response: %v", err)
+			}
+			if res.OK != tt.wantOK || res.ID != tt.cmd.ID ||
+				res.Result != tt.wantResult {
+				t.Errorf("handle() response = %+v, want OK %v result %q",
+					res, tt.wantOK, tt.wantResult)
+			}
+			if tt.checkFn != nil {
+				tt.checkFn(t, c, client)
+			}
+		})
+	}
+}
+
+func Test_controller_recorder(t *testing.T) {
+	c := newController(cfg{Control: controlOptions{
+		Topic: "go-mli/control",
+		Token: "secret",
+	}}, nil)
+	var got []string
+	rec := c.recorder(func(s1, s2 string, meta *msgMeta) {
+		got = append(got, s1)
+	})
+	rec("demo", "1", &msgMeta{})
+	rec("go-mli/control", "{}", &msgMeta{})
+	rec("go-mli/control/response", "{}", &msgMeta{})
+	c.paused.Store(true)
+	rec("demo", "2", &msgMeta{})
+	rec(MARKER_TOPIC, "paused", nil)
+	want := []string{"demo", MARKER_TOPIC}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("recorder() recorded %v, want %v", got, want)
+	}
+}
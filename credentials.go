@@ -0,0 +1,138 @@
+// credentials.go - Credentials Provider
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Credentials Provider
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Default time limit for the credentials command
+	CREDENTIALS_TIMEOUT = 10 * time.Second
+)
+
+// usesCredentials reports if the supplied credentials provider is active.
+func usesCredentials(c credentialsOptions) bool {
+	return len(c.Command) > 0 || len(c.File) > 0
+}
+
+// checkCredentials validates the supplied credentials provider settings.
+func checkCredentials(c credentialsOptions) error {
+	if len(c.Command) > 0 && len(c.File) > 0 {
+		return fmt.Errorf("credentials need either a command or a file")
+	}
+	if len(c.Command) > 0 && len(c.Command[0]) == 0 {
+		return fmt.Errorf("empty credentials command")
+	}
+	return nil
+}
+
+// fetchPassword gets the current password from the configured command
+// output or file, with the surrounding white space removed.
+func fetchPassword(c credentialsOptions) (string, error) {
+	var out []byte
+	if len(c.Command) > 0 {
+		timeout := time.Duration(c.Timeout)
+		if timeout <= 0 {
+			timeout = CREDENTIALS_TIMEOUT
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+		cmd.Stderr = &stderr
+		// Do not wait for children of the command holding the output
+		cmd.WaitDelay = time.Second
+		var err error
+		out, err = cmd.Output()
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("credentials command %q timed out after %v",
+				c.Command[0], timeout)
+		}
+		if err != nil {
+			return "", fmt.Errorf("credentials command %q failed:\n %v %s",
+				c.Command[0], err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		var err error
+		out, err = os.ReadFile(c.File)
+		if err != nil {
+			return "", fmt.Errorf("failed to read credentials file %q:\n %v",
+				c.File, err)
+		}
+	}
+	password := strings.TrimSpace(string(out))
+	if len(password) == 0 {
+		return "", fmt.Errorf("credentials provider gave an empty password")
+	}
+	return password, nil
+}
+
+// credentialsProvider creates the function called before every connection
+// attempt to get the fresh password. Upon failure the configured Password
+// is used, so the Broker refuses the connection with the reason logged.
+func credentialsProvider(m cfg) mqtt.CredentialsProvider {
+	return func() (string, string) {
+		password, err := fetchPassword(m.Credentials)
+		if err != nil {
+			log.Printf("[MQTT][ERROR] Failed to get the credentials, "+
+				"using the configured password:\n %v\n", err)
+			return m.Username, m.Password
+		}
+		log.Println("[MQTT] Credentials refreshed")
+		return m.Username, password
+	}
+}
@@ -0,0 +1,197 @@
+// credentials_test.go - Credentials Provider Tests
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Credentials Provider - Tests
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_fetchPassword(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte(" jwt.token.here\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+	tests := []struct {
+		name      string
+		c         credentialsOptions
+		shell     bool
+		want      string
+		wantErrIn string
+	}{
+		{
+			name: "Password from File",
+			c:    credentialsOptions{File: tokenFile},
+			want: "jwt.token.here",
+		},
+		{
+			name:  "Password from Command",
+			c:     credentialsOptions{Command: []string{"sh", "-c", "echo cmd.token"}},
+			shell: true,
+			want:  "cmd.token",
+		},
+		{
+			name:      "Negative Test - Missing File",
+			c:         credentialsOptions{File: filepath.Join(dir, "missing")},
+			wantErrIn: "failed to read credentials file",
+		},
+		{
+			name:      "Negative Test - Empty File",
+			c:         credentialsOptions{File: emptyFile},
+			wantErrIn: "empty password",
+		},
+		{
+			name: "Negative Test - Command Failure",
+			c: credentialsOptions{
+				Command: []string{"sh", "-c", "echo expired >&2; exit 3"},
+			},
+			shell:     true,
+			wantErrIn: "expired",
+		},
+		{
+			name: "Negative Test - Command Timeout",
+			c: credentialsOptions{
+				Command: []string{"sh", "-c", "sleep 5"},
+				Timeout: duration(100 * time.Millisecond),
+			},
+			shell:     true,
+			wantErrIn: "timed out",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.shell && runtime.GOOS == "windows" {
+				t.Skip("needs a POSIX shell")
+			}
+			got, err := fetchPassword(tt.c)
+			if len(tt.wantErrIn) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrIn) {
+					t.Fatalf("fetchPassword() error = %v, want %q",
+						err, tt.wantErrIn)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchPassword() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("fetchPassword() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_credentialsProvider(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	m := cfg{
+		Username:    "user",
+		Password:    "static",
+		Credentials: credentialsOptions{File: tokenFile},
+	}
+	provider := credentialsProvider(m)
+	// Fallback to the configured password without the file
+	if u, p := provider(); u != "user" || p != "static" {
+		t.Errorf("provider() = %q, %q, want the configured password", u, p)
+	}
+	// Refreshed token on every call
+	for _, token := range []string{"token1", "token2"} {
+		if err := os.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+			t.Fatalf("failed to write token: %v", err)
+		}
+		if u, p := provider(); u != "user" || p != token {
+			t.Errorf("provider() = %q, %q, want %q", u, p, token)
+		}
+	}
+}
+
+func Test_checkCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       credentialsOptions
+		wantErr bool
+	}{
+		{
+			name: "Command",
+			c:    credentialsOptions{Command: []string{"get-token"}},
+		},
+		{
+			name: "File",
+			c:    credentialsOptions{File: "token"},
+		},
+		{
+			name: "Negative Test - Command and File",
+			c: credentialsOptions{
+				Command: []string{"get-token"},
+				File:    "token",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Negative Test - Empty Command",
+			c:       credentialsOptions{Command: []string{""}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCredentials(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkCredentials() error = %v, wantErr %v",
+					err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,10 +2,13 @@ module github.com/boseji/go-mli
 
 go 1.24.2
 
-require github.com/eclipse/paho.mqtt.golang v1.5.1
-
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	golang.org/x/net v0.44.0 // indirect
-	golang.org/x/sync v0.17.0 // indirect
+	github.com/BurntSushi/toml v1.5.0
+	github.com/eclipse/paho.golang v0.23.0
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/net v0.44.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sync v0.17.0 // indirect
@@ -48,14 +48,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 const (
@@ -77,8 +82,13 @@ func main() {
 
 	// Define Flags
 	cfgFile := flag.String("config", "config.json",
-		"JSON File containing the Configuration.")
+		"JSON, YAML or TOML File containing the Configuration.")
 	ver := flag.Bool("v", false, "Version number of the program")
+	merge := flag.String("merge", "",
+		"Merge the CSV log files given as arguments into this file in time order,\n"+
+			"to the millisecond for Instance logs, else to the second.")
+	probe := flag.Bool("probe", false,
+		"Check the connection to the Brokers step by step and exit.")
 	flag.Parse()
 
 	log.Println("[main] Flag Processed: ", flag.Parsed())
@@ -89,6 +99,17 @@ func main() {
 		return
 	}
 
+	// Merge the Instance log files only
+	if len(*merge) > 0 {
+		err := mergeLogs(*merge, flag.Args())
+		if err != nil {
+			log.Fatalf("[main][ERROR] Failed to merge the log files -\n%v", err)
+		}
+		log.Printf("[main] Merged %d log files into %q\n",
+			len(flag.Args()), *merge)
+		return
+	}
+
 	// Get the Config File
 	configFile, err := filepath.Abs(*cfgFile)
 	if err != nil {
@@ -110,12 +131,141 @@ func main() {
 	// Load Message
 	log.Println("[main] `go-mli` Boseji's Golang MQTT Logging command line")
 	log.Println("[main] Configuration Loaded -", configFile)
+	log.Println("[main] Configuration Values", cfg.sourcesString(configFile))
 	log.Println("[main] Present Configuration: \n", cfg)
 
+	// Optional Columns
+	err = checkMetaColumns(cfg.Columns)
+	if err != nil {
+		log.Fatalf("[main][ERROR] Invalid columns -\n%v", err)
+	}
+
+	// Brokers to log from
+	sessions, err := cfg.sessions()
+	if err != nil {
+		log.Fatalf("[main][ERROR] Invalid broker sections -\n%v", err)
+	}
+
+	// Resolve the Client IDs to avoid session takeover between loggers
+	for i, sess := range sessions {
+		id, err := expandClientID(sess.ClientID)
+		if err != nil {
+			log.Fatalf("[main][ERROR] Invalid client id %q -\n%v",
+				sess.ClientID, err)
+		}
+		if id != sess.ClientID {
+			log.Printf("[main] Client ID %q resolved to %q\n", sess.ClientID, id)
+			if sess.Session.Persistent &&
+				(strings.Contains(sess.ClientID, "{rand") ||
+					strings.Contains(sess.ClientID, "{pid}")) {
+				log.Printf("[main][WARNING] Changing Client ID %q cannot resume "+
+					"the persistent session on restart\n", sess.ClientID)
+			}
+		}
+		if len(id) > CLIENT_ID_MAX {
+			log.Printf("[main][WARNING] Client ID %q is longer than %d "+
+				"characters, some Brokers may reject it\n", id, CLIENT_ID_MAX)
+		}
+		sessions[i].ClientID = id
+	}
+
+	// Connection diagnostics only
+	if *probe {
+		failed := false
+		for _, sess := range sessions {
+			log.Printf("[main] Probing %q..\n", sess.Name)
+			if err := probeMQTT(sess); err != nil {
+				log.Printf("[main][ERROR] Probe of %q failed -\n%v\n",
+					sess.Name, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		log.Println("[main] Probe completed successfully.")
+		return
+	}
+
 	// Create the Handlers
-	loggingFile := time.Now().Format("log-2006-01-02T15-04-05.csv")
-	logChan := make(chan string, len(cfg.Topics)*2)
-	recFn := getRecorder(logChan, ctx, &wg, STORE_WAIT*2)
+	fileStamp := func() string {
+		stamp := time.Now().Format("2006-01-02T15-04-05")
+		if len(cfg.InstanceID) > 0 {
+			// Separate files for each Instance
+			stamp = cfg.InstanceID + "-" + stamp
+		}
+		return stamp
+	}
+	stamp := fileStamp()
+	loggingFile := "log-" + stamp + ".csv"
+	sysFile := "sys-" + stamp + ".csv"
+	depth := 0
+	sysStats := false
+	for _, sess := range sessions {
+		if sess.Connection.ChannelDepth > 0 {
+			depth += sess.Connection.ChannelDepth
+		} else {
+			depth += len(sess.Topics) * 2
+		}
+		sysStats = sysStats || sess.SysStats
+	}
+	logChan := make(chan string, depth)
+	sysChan := make(chan string, SYS_DEPTH)
+	var tagColumns []string
+	if len(cfg.InstanceID) > 0 {
+		tagColumns = append(tagColumns, STORE_INSTANCE_COLUMN)
+		// Precise time stamps to merge the Instance logs in order
+		storeTimeFormat = STORE_TIME_FORMAT_MS
+	}
+	if len(cfg.Sections) > 0 {
+		// Multiple Brokers need the Broker column
+		tagColumns = append(tagColumns, STORE_BROKER_COLUMN)
+	}
+	header := storeHeader(tagColumns, cfg.Columns)
+	sysHeader := storeHeader(tagColumns, []string{SYS_VALUE_COLUMN})
+	// Log file rotation through the control topic
+	logRotate := make(chan string)
+	sysRotate := make(chan string)
+	rotate := func() (string, error) {
+		stamp := fileStamp()
+		files := []string{"log-" + stamp + ".csv"}
+		rotates := []chan string{logRotate}
+		if sysStats {
+			files = append(files, "sys-"+stamp+".csv")
+			rotates = append(rotates, sysRotate)
+		}
+		for i, f := range files {
+			select {
+			case rotates[i] <- f:
+			case <-time.After(CONTROL_TIMEOUT):
+				return "", fmt.Errorf("storage not running for %q", f)
+			}
+		}
+		return strings.Join(files, ","), nil
+	}
+	recFns := make([]recorderFn, len(sessions))
+	statuses := make([]*loggerStatus, len(sessions))
+	controls := make([]*controller, len(sessions))
+	for i, sess := range sessions {
+		var tags []string
+		if len(cfg.InstanceID) > 0 {
+			tags = append(tags, cfg.InstanceID)
+		}
+		if len(cfg.Sections) > 0 {
+			tags = append(tags, sess.Name)
+		}
+		recFns[i] = getTagRecorder(logChan, ctx, &wg, STORE_WAIT*2,
+			cfg.Columns, tags...)
+		if sess.SysStats {
+			// Broker statistics go to their own file
+			recFns[i] = sysRecorder(recFns[i],
+				getSysRecorder(sysChan, ctx, &wg, STORE_WAIT*2, tags...))
+		}
+		controls[i] = newController(sess, rotate)
+		recFns[i] = controls[i].recorder(recFns[i])
+		statuses[i] = newLoggerStatus(sess)
+		recFns[i] = statuses[i].countRecorder(recFns[i])
+	}
 
 	// Handle Ctrl+C
 	signalChan := make(chan os.Signal, 1)
@@ -143,43 +293,69 @@ func main() {
 		close(exitChan) // For Exit
 	}()
 
-	// Create MQTT Connection
-	mqttOptions := setupMQTT(cfg, cancel, recFn)
-	client, err := connectMQTT(mqttOptions)
-	if err != nil {
-		log.Printf("[main][ERROR] Failed to connect to the MQTT Broker - \n %v", err)
-		cancel()
-	}
-
-	// Only upon Successful Connection
-	if client != nil {
-		// Start the Storage Process
-		wg.Add(1)
-		go storeGoroutine(logChan, ctx, &wg, loggingFile)
-
-		// Subscribe to the desired topics
-		for _, topic := range cfg.Topics {
-			err = subscribeMQTT(client, topic)
-			if err != nil {
-				log.Printf("[main][ERROR] Failed to subscribe to %q\n %v\n",
-					topic, err)
-				cancel()
+	// Create MQTT Connections for all the Brokers in parallel
+	var storeOnce sync.Once
+	var connWg sync.WaitGroup
+	clients := make([]mqtt.Client, len(sessions))
+	clients5 := make([]*autopaho.ConnectionManager, len(sessions))
+	for i, sess := range sessions {
+		connWg.Add(1)
+		go func() {
+			defer connWg.Done()
+			// Start the Storage Process upon first Connection
+			startStore := func() {
+				storeOnce.Do(func() {
+					wg.Add(1)
+					go storeGoroutine(logChan, ctx, &wg, loggingFile,
+						header, logRotate)
+					if sysStats {
+						wg.Add(1)
+						go storeGoroutine(sysChan, ctx, &wg, sysFile,
+							sysHeader, sysRotate)
+					}
+				})
 			}
-		}
+			if sess.ProtocolVersion == PROTOCOL_MQTT5 {
+				clients5[i] = startSession5(ctx, cancel, sess, recFns[i],
+					startStore)
+				return
+			}
+			clients[i] = startSession(ctx, cancel, sess, recFns[i],
+				statuses[i], controls[i], startStore)
+		}()
 	}
 
 	// Wait for Exit with SIGINT or SIGKILL
 	<-exitChan
 
 	// Only upon Successful Connection
-	if client != nil {
-		log.Println("[main] Closing connection..")
+	connWg.Wait()
+	for i, client := range clients {
+		if client == nil {
+			continue
+		}
+		log.Printf("[main] Closing connection %q..\n", sessions[i].Name)
+		err = statuses[i].publish(client, STATUS_STOPPED)
+		if err != nil {
+			log.Printf("[main][ERROR] Failed to publish the status : %v\n", err)
+		}
 		err = disconnectMQTT(client, 20)
 		if err != nil {
 			log.Printf("[main][ERROR] Failed to close MQTT Connection : %v\n", err)
 			cancel()
 		}
 	}
+	for i, cm := range clients5 {
+		if cm == nil {
+			continue
+		}
+		log.Printf("[main] Closing connection %q..\n", sessions[i].Name)
+		err = disconnectMQTT5(cm, 250)
+		if err != nil {
+			log.Printf("[main][ERROR] Failed to close MQTT Connection : %v\n", err)
+			cancel()
+		}
+	}
 
 	// Error in exit
 	if isError {
@@ -196,3 +372,100 @@ func main() {
 	fmt.Println()
 	os.Exit(0)
 }
+
+// startSession connects to the Broker of the supplied configuration and
+// subscribes to its topics. The status messages are published as per
+// the supplied logger status, and the commands on the control topic are
+// handled by the supplied controller. The onConnect function is called after the
+// connection and before the subscriptions. It returns the client upon
+// successful connection, else nil after cancelling the context.
+func startSession(ctx context.Context, cancel context.CancelFunc,
+	m cfg, rec recorderFn, st *loggerStatus, ctrl *controller,
+	onConnect func()) mqtt.Client {
+	// Create MQTT Connection
+	d := newDispatcher(m, rec)
+	mqttOptions, err := setupMQTT(m, cancel, d)
+	if err == nil {
+		err = st.setup(mqttOptions)
+	}
+	if err == nil {
+		err = ctrl.setup(mqttOptions, d)
+	}
+	if err != nil {
+		log.Printf("[main][ERROR] Failed to setup the MQTT options %q - \n %v",
+			m.Name, err)
+		cancel()
+		return nil
+	}
+	client, err := connectRetryMQTT(ctx, mqttOptions, m.ConnectRetry)
+	if err != nil {
+		// Interrupted by Ctrl+C is not a failure
+		if ctx.Err() == nil {
+			log.Printf("[main][ERROR] Failed to connect to the MQTT Broker %q - \n %v",
+				m.Name, err)
+		}
+		cancel()
+		return nil
+	}
+	onConnect()
+
+	// Subscribe to the desired topics
+	topics := m.subscribeTopics()
+	res := subscribeAllMQTT(client, topics, m.Subscribe.BatchSize)
+	checkSubscriptions(cancel, m, topics, res)
+	return client
+}
+
+// startSession5 connects to the Broker of the supplied configuration with
+// MQTT 5 and subscribes to its topics, in the same way as startSession.
+// It returns the connection upon success, else nil after cancelling the
+// context.
+func startSession5(ctx context.Context, cancel context.CancelFunc,
+	m cfg, rec recorderFn, onConnect func()) *autopaho.ConnectionManager {
+	// Create MQTT Connection
+	config, err := setupMQTT5(m, cancel, newDispatcher(m, rec))
+	if err != nil {
+		log.Printf("[main][ERROR] Failed to setup the MQTT 5 options %q - \n %v",
+			m.Name, err)
+		cancel()
+		return nil
+	}
+	cm, err := connectMQTT5(ctx, config, m.ConnectRetry)
+	if err != nil {
+		// Interrupted by Ctrl+C is not a failure
+		if ctx.Err() == nil {
+			log.Printf("[main][ERROR] Failed to connect to the MQTT Broker %q - \n %v",
+				m.Name, err)
+		}
+		cancel()
+		return nil
+	}
+	onConnect()
+
+	// Subscribe to the desired topics
+	topics := m.subscribeTopics()
+	res := subscribeAllMQTT5(cm, topics, m.Subscribe.BatchSize, m.MQTT5)
+	checkSubscriptions(cancel, m, topics, res)
+	return cm
+}
+
+// checkSubscriptions reports the results of the subscriptions and cancels
+// the context upon failure, unless the denied subscriptions are allowed.
+func checkSubscriptions(cancel context.CancelFunc, m cfg, topics []topic,
+	res map[string]error) {
+	for _, t := range topics {
+		if !t.Enabled {
+			log.Printf("[main] Skipping disabled topic %q\n", t.Filter)
+			continue
+		}
+		err := res[t.Filter]
+		if errors.Is(err, errSubscriptionDenied) && m.Subscribe.AllowDenied {
+			log.Printf("[main][WARNING] Not logging %q\n %v\n",
+				t.Filter, err)
+		} else if err != nil {
+			log.Printf("[main][ERROR] Failed to subscribe to %q\n %v\n",
+				t.Filter, err)
+			cancel()
+		}
+	}
+}
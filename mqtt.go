@@ -50,63 +50,417 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+const (
+	// Topic used for the records generated by the logger itself
+	MARKER_TOPIC = "[go-mli]"
+	// Suffix for the topic of the marked retained messages
+	RETAINED_SUFFIX = " [retained]"
+	// Default wait after the first failed connection attempt
+	RETRY_INITIAL_DELAY = time.Second
+	// Default upper limit for the wait between connection attempts
+	RETRY_MAX_DELAY = time.Minute
+	// Default directory for the persistent session store
+	SESSION_STORE_DIR = "mqtt-store"
+	// SUBACK return code for a rejected subscription, MQTT 5 has
+	// further reasons above it
+	SUBACK_FAILURE = 0x80
+	// MQTT protocol versions
+	PROTOCOL_MQTT31  = 3
+	PROTOCOL_MQTT311 = 4
+	PROTOCOL_MQTT5   = 5
+	// Default number of topic filters in a single SUBSCRIBE packet
+	SUBSCRIBE_BATCH = 32
+	// Largest keep alive allowed by the MQTT protocol
+	KEEPALIVE_MAX = 65535 * time.Second
+	// Connection lost within this period after connecting hints at
+	// another client using the same Client ID
+	TAKEOVER_WINDOW = 5 * time.Second
+	// Number of such quick connection losses in a row to report
+	TAKEOVER_COUNT = 3
+)
+
+// tlsVersions maps the configuration names to the TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// usesTLS reports if the supplied configuration needs a custom
+// TLS configuration.
+func usesTLS(m cfg) bool {
+	return len(m.CAFile) > 0 || len(m.ClientCertFile) > 0 ||
+		len(m.ClientKeyFile) > 0 || len(m.TLS.ServerName) > 0 ||
+		m.TLS.InsecureSkipVerify || len(m.TLS.MinVersion) > 0 ||
+		len(m.TLS.CipherSuites) > 0 || m.TLS.UseSystemRoots
+}
+
+// cipherSuiteID finds the ID of the cipher suite with the supplied name.
+func cipherSuiteID(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, nil
+		}
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			log.Printf("[MQTT][WARNING] Insecure cipher suite %q enabled\n",
+				name)
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// setupTLS builds the TLS configuration from the CA, client
+// certificate files and TLS options in the supplied configuration.
+func setupTLS(m cfg) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         m.TLS.ServerName,
+		InsecureSkipVerify: m.TLS.InsecureSkipVerify,
+	}
+	if m.TLS.InsecureSkipVerify {
+		log.Println("[MQTT][WARNING] !!! TLS certificate verification " +
+			"is DISABLED - the Broker identity is NOT checked !!!")
+	}
+	// Minimum TLS Version
+	if len(m.TLS.MinVersion) > 0 {
+		ver, ok := tlsVersions[m.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q",
+				m.TLS.MinVersion)
+		}
+		tlsCfg.MinVersion = ver
+	}
+	// Cipher Suites
+	for _, name := range m.TLS.CipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, id)
+	}
+	// If CA files are available
+	if len(m.CAFile) > 0 {
+		certPool := x509.NewCertPool()
+		if m.TLS.UseSystemRoots {
+			sysPool, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, fmt.Errorf("failed to load system roots:\n %v",
+					err)
+			}
+			certPool = sysPool
+		}
+		ca, err := os.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %q:\n %v",
+				m.CAFile, err)
+		}
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid PEM certificates in CA file %q",
+				m.CAFile)
+		}
+		tlsCfg.RootCAs = certPool
+	}
+	// If Client Certificate and Key are available
+	if len(m.ClientCertFile) > 0 || len(m.ClientKeyFile) > 0 {
+		if len(m.ClientCertFile) == 0 || len(m.ClientKeyFile) == 0 {
+			return nil, fmt.Errorf("both client certificate and key " +
+				"files are needed for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(m.ClientCertFile, m.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key pair "+
+				"%q, %q:\n %v", m.ClientCertFile, m.ClientKeyFile, err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
 // setupMQTT setups up the options for the MQTT connection from the
-// supplied configuration and returns the same.
+// supplied configuration and returns the same. The received messages
+// and the connection markers are recorded through the dispatcher.
 func setupMQTT(m cfg,
 	cancel context.CancelFunc,
-	rec recorderFn) *mqtt.ClientOptions {
+	d *dispatcher) (*mqtt.ClientOptions, error) {
+	rec := d.rec
 	// From (https://www.emqx.com/en/blog/how-to-use-mqtt-in-golang)
 
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(m.ADDR)
+	// Brokers in the order of failover
+	for _, b := range m.brokerList() {
+		opts.AddBroker(b)
+	}
 	opts.SetClientID(m.ClientID)
+	// MQTT 3.1 or 3.1.1, MQTT 5 needs setupMQTT5
+	switch m.ProtocolVersion {
+	case 0:
+	case PROTOCOL_MQTT31, PROTOCOL_MQTT311:
+		opts.SetProtocolVersion(uint(m.ProtocolVersion))
+	case PROTOCOL_MQTT5:
+		return nil, fmt.Errorf("MQTT 5 is not supported by this client")
+	default:
+		return nil, fmt.Errorf("unknown protocol version %d",
+			m.ProtocolVersion)
+	}
 	// If Username is available
 	if len(m.Username) > 0 {
 		opts.SetUsername(m.Username)
 		opts.SetPassword(m.Password)
 	}
-	// If CA files are available
-	if len(m.CAFile) > 0 {
-		certPool := x509.NewCertPool()
-		ca, err := os.ReadFile(m.CAFile)
+	// Fresh password before every connection
+	if usesCredentials(m.Credentials) {
+		if err := checkCredentials(m.Credentials); err != nil {
+			return nil, err
+		}
+		opts.SetCredentialsProvider(credentialsProvider(m))
+	}
+	// If CA, Client Certificate files or TLS options are available
+	if usesTLS(m) {
+		tlsCfg, err := setupTLS(m)
 		if err != nil {
-			log.Fatalln(err.Error())
+			return nil, err
 		}
-		certPool.AppendCertsFromPEM(ca)
-		opts.SetTLSConfig(&tls.Config{
-			RootCAs: certPool,
-		})
+		opts.SetTLSConfig(tlsCfg)
 	}
 
+	// WebSocket Options
+	if len(m.WebSocket.Headers) > 0 {
+		h := make(http.Header)
+		for k, v := range m.WebSocket.Headers {
+			h.Set(k, v)
+		}
+		opts.SetHTTPHeaders(h)
+	}
+	if m.WebSocket.ReadBufferSize < 0 || m.WebSocket.WriteBufferSize < 0 {
+		return nil, fmt.Errorf("invalid websocket buffer sizes %d, %d",
+			m.WebSocket.ReadBufferSize, m.WebSocket.WriteBufferSize)
+	}
+	wsOpts := &mqtt.WebsocketOptions{
+		ReadBufferSize:  m.WebSocket.ReadBufferSize,
+		WriteBufferSize: m.WebSocket.WriteBufferSize,
+	}
+	if m.WebSocket.NoProxy {
+		wsOpts.Proxy = func(req *http.Request) (*url.URL, error) {
+			return nil, nil
+		}
+	}
+	// Proxy for all the connections
+	if usesProxy(m.Proxy) {
+		// Catch configuration errors early
+		if _, err := resolveProxy(m.Proxy, ""); err != nil {
+			return nil, err
+		}
+		for _, b := range m.brokerList() {
+			u, err := url.Parse(b)
+			if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+				continue
+			}
+			if _, err := websocketProxy(m.Proxy, u.Hostname()); err != nil {
+				return nil, fmt.Errorf("failed to setup proxy for %q:\n %v",
+					u.Redacted(), err)
+			}
+		}
+		wsOpts.Proxy = func(req *http.Request) (*url.URL, error) {
+			return websocketProxy(m.Proxy, req.URL.Hostname())
+		}
+		opts.SetCustomOpenConnectionFn(proxyConnection(m.Proxy))
+	}
+	opts.SetWebsocketOptions(wsOpts)
+
 	// Set Callbacks
+	// All the messages go through the dispatcher, so no routes
 	opts.SetDefaultPublishHandler(
 		func(client mqtt.Client, msg mqtt.Message) {
-			log.Printf("[MQTT] Received message: %q from topic: %q\n",
-				msg.Payload(), msg.Topic())
-			// Send for Record
-			rec(msg.Topic(), string(msg.Payload()))
+			d.handle(msg)
+		})
+	var connected atomic.Bool
+	var takeover takeoverDetector
+	var resubscribe sync.Mutex
+	var broker atomic.Value
+	broker.Store("")
+	opts.SetConnectionNotificationHandler(
+		func(client mqtt.Client, n mqtt.ConnectionNotification) {
+			switch n := n.(type) {
+			case mqtt.ConnectionNotificationBroker:
+				broker.Store(n.Broker.Redacted())
+			case mqtt.ConnectionNotificationBrokerFailed:
+				log.Printf("[MQTT] Broker %s unreachable: %v\n",
+					n.Broker.Redacted(), n.Reason)
+			}
 		})
 	opts.SetOnConnectHandler(
 		func(client mqtt.Client) {
-			log.Println("[MQTT] Connected to Broker")
+			// First Connection - Subscriptions are done by the caller
+			takeover.connected(time.Now())
+			if !connected.Swap(true) {
+				log.Printf("[MQTT] Connected to Broker %s\n", broker.Load())
+				return
+			}
+			log.Printf("[MQTT] Reconnected to Broker %s\n", broker.Load())
+			rec(MARKER_TOPIC, fmt.Sprintf("reconnected: %s", broker.Load()), nil)
+			// Restore the Subscriptions, one refresh at a time
+			resubscribe.Lock()
+			defer resubscribe.Unlock()
+			res := subscribeAllMQTT(client, m.subscribeTopics(),
+				m.Subscribe.BatchSize)
+			for filter, err := range res {
+				if err != nil {
+					log.Printf("[MQTT][ERROR] Failed to resubscribe to %q\n %v\n",
+						filter, err)
+				}
+			}
 		})
 	opts.SetConnectionLostHandler(
 		func(client mqtt.Client, err error) {
 			log.Printf("[MQTT] Connect lost: %v", err)
-			cancel()
+			n := takeover.lost(time.Now())
+			if n >= TAKEOVER_COUNT || (n > 0 && m.Reconnect.Disabled) {
+				log.Printf("[MQTT][ERROR] Connection lost %d time(s) right "+
+					"after connecting - another client is probably using "+
+					"the Client ID %q (session takeover)\n", n, m.ClientID)
+				rec(MARKER_TOPIC, fmt.Sprintf("session takeover suspected: %q",
+					m.ClientID), nil)
+			}
+			if m.Reconnect.Disabled {
+				cancel()
+				return
+			}
+			rec(MARKER_TOPIC, "disconnected: "+err.Error(), nil)
+		})
+	opts.SetReconnectingHandler(
+		func(client mqtt.Client, opts *mqtt.ClientOptions) {
+			log.Println("[MQTT] Trying to reconnect..")
 		})
 
-	// Clean Sessions for each run
-	opts.SetCleanSession(true)
+	// Keep Alive and Timeouts
+	if err := setupConnection(opts, m.Connection); err != nil {
+		return nil, err
+	}
+
+	// Automatic Reconnection
+	opts.SetAutoReconnect(!m.Reconnect.Disabled)
+	if m.Reconnect.MaxInterval > 0 {
+		opts.SetMaxReconnectInterval(time.Duration(m.Reconnect.MaxInterval))
+	}
+
+	// Persistent Sessions with messages stored on disk
+	if m.Session.Persistent {
+		dir, err := sessionStoreDir(m)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetStore(mqtt.NewFileStore(dir))
+		opts.SetCleanSession(false)
+		opts.SetResumeSubs(true)
+		log.Printf("[MQTT] Persistent session stored in %q\n", dir)
+	} else {
+		// Clean Sessions for each run
+		opts.SetCleanSession(true)
+	}
+
+	return opts, nil
+}
+
+// sessionStoreDir creates the directory for the persistent session store
+// of the Client and returns the same.
+func sessionStoreDir(m cfg) (string, error) {
+	if len(m.ClientID) == 0 {
+		return "", fmt.Errorf("persistent session needs a ClientID")
+	}
+	dir := m.Session.StoreDir
+	if len(dir) == 0 {
+		dir = SESSION_STORE_DIR
+	}
+	// Separate store for each Client
+	dir = filepath.Join(dir, m.ClientID)
+	err := os.MkdirAll(dir, 0770)
+	if err != nil {
+		return "", fmt.Errorf("failed to create session store %q:\n %v",
+			dir, err)
+	}
+	return dir, nil
+}
+
+// setupConnection applies the keep alive and timeouts from the supplied
+// connection settings to the MQTT options after validating them.
+// Zero values keep the paho defaults.
+func setupConnection(opts *mqtt.ClientOptions, c connectionOptions) error {
+	keepAlive := time.Duration(c.KeepAlive)
+	if keepAlive > 0 {
+		// Sent in whole seconds in the CONNECT packet
+		if keepAlive%time.Second != 0 || keepAlive > KEEPALIVE_MAX {
+			return fmt.Errorf("invalid keep alive %v, needs whole seconds "+
+				"up to %v", keepAlive, KEEPALIVE_MAX)
+		}
+		opts.SetKeepAlive(keepAlive)
+	}
+	keepAlive = time.Duration(opts.KeepAlive) * time.Second
+	if c.PingTimeout > 0 {
+		opts.SetPingTimeout(time.Duration(c.PingTimeout))
+		if opts.PingTimeout >= keepAlive {
+			return fmt.Errorf("ping timeout %v needs to be shorter than "+
+				"the keep alive %v", opts.PingTimeout, keepAlive)
+		}
+	} else if opts.PingTimeout >= keepAlive {
+		// Default too long for a short keep alive
+		opts.SetPingTimeout(keepAlive / 2)
+	}
+	if c.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(time.Duration(c.ConnectTimeout))
+	}
+	if c.WriteTimeout > 0 {
+		opts.SetWriteTimeout(time.Duration(c.WriteTimeout))
+	}
+	if c.ChannelDepth < 0 {
+		return fmt.Errorf("invalid channel depth %d", c.ChannelDepth)
+	}
+	return nil
+}
+
+// takeoverDetector counts the connection losses right after connecting,
+// which is how the Broker drops a client when another client connects
+// with the same Client ID.
+type takeoverDetector struct {
+	mu          sync.Mutex
+	connectedAt time.Time
+	quickLosses int
+}
 
-	return opts
+// connected notes the time of the connection.
+func (d *takeoverDetector) connected(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connectedAt = now
+}
+
+// lost notes the connection loss and returns the number of quick losses
+// in a row, 0 if the connection was stable.
+func (d *takeoverDetector) lost(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.connectedAt.IsZero() || now.Sub(d.connectedAt) >= TAKEOVER_WINDOW {
+		d.quickLosses = 0
+		return 0
+	}
+	d.quickLosses++
+	return d.quickLosses
 }
 
 // connectMQTT creates the MQTT Client using the supplied MQTT options
@@ -120,6 +474,51 @@ func connectMQTT(opts *mqtt.ClientOptions) (mqtt.Client, error) {
 	return client, nil
 }
 
+// connectRetryMQTT creates the MQTT Client using the supplied MQTT options
+// and keeps retrying the connection with an exponential backoff as per the
+// retry settings. It stops early when the context gets cancelled.
+func connectRetryMQTT(ctx context.Context, opts *mqtt.ClientOptions,
+	r connectRetryOptions) (mqtt.Client, error) {
+	delay := time.Duration(r.InitialDelay)
+	if delay <= 0 {
+		delay = RETRY_INITIAL_DELAY
+	}
+	maxDelay := time.Duration(r.MaxDelay)
+	if maxDelay <= 0 {
+		maxDelay = RETRY_MAX_DELAY
+	}
+
+	for attempt := 1; ; attempt++ {
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		select {
+		case <-ctx.Done():
+			// Abort the attempt in progress, else it can still connect
+			client.Disconnect(0)
+			return nil, fmt.Errorf("connection cancelled: %v", ctx.Err())
+		case <-token.Done():
+		}
+		if token.Error() == nil {
+			return client, nil
+		}
+		if !r.Enabled || (r.MaxAttempts > 0 && attempt >= r.MaxAttempts) {
+			return nil, fmt.Errorf("failed to connect to mqtt after %d "+
+				"attempt(s):\n %v", attempt, token.Error())
+		}
+		log.Printf("[MQTT] Connection attempt %d failed, retrying in %v:\n %v\n",
+			attempt, delay, token.Error())
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connection cancelled: %v", ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
 // disconnectMQTT helps to disconnect the client within a given time period
 // supplied in number of milliseconds.
 func disconnectMQTT(client mqtt.Client, ms uint) error {
@@ -134,17 +533,201 @@ func disconnectMQTT(client mqtt.Client, ms uint) error {
 	return fmt.Errorf("mqtt not connected")
 }
 
-// subscribeMQTT helps to create subscription to the supplied topics
-// for the client.
-func subscribeMQTT(client mqtt.Client, topic string) error {
-	if client == nil {
-		return fmt.Errorf("no client")
+// errSubscriptionDenied reports a subscription rejected by the Broker.
+var errSubscriptionDenied = errors.New("subscription denied by broker")
+
+// checkSubAck verifies the QoS granted by the Broker in the SUBACK for the
+// supplied topic and reports the denials and downgrades.
+func checkSubAck(t topic, result map[string]byte) error {
+	granted, ok := result[t.Filter]
+	if !ok {
+		return fmt.Errorf("no result in SUBACK for %q", t.Filter)
 	}
-	token := client.Subscribe(topic, 1, nil)
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to %q:\n %v",
-			topic, token.Error())
+	if granted >= SUBACK_FAILURE {
+		return fmt.Errorf("%w: %q return code 0x%02X",
+			errSubscriptionDenied, t.Filter, granted)
+	}
+	if granted < t.QoS {
+		log.Printf("[MQTT][WARNING] QoS downgraded for %q from %d to %d\n",
+			t.Filter, t.QoS, granted)
 	}
-	log.Printf("[MQTT] Subscribed to topic: %q\n", topic)
 	return nil
 }
+
+// newMsgMeta collects the metadata of the supplied MQTT message, including
+// the properties of MQTT 5 messages.
+func newMsgMeta(msg mqtt.Message) *msgMeta {
+	meta := &msgMeta{
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Duplicate: msg.Duplicate(),
+		MessageID: msg.MessageID(),
+	}
+	if m5, ok := msg.(*message5); ok {
+		m5.properties(meta)
+	}
+	return meta
+}
+
+// applyRetained applies the retained policy to the supplied message.
+// It returns the name to record, which is marked for retained messages
+// as needed, and if the message should be recorded at all.
+func applyRetained(policy string, name string, msg mqtt.Message) (string, bool) {
+	if !msg.Retained() {
+		return name, true
+	}
+	switch policy {
+	case RETAINED_MARK:
+		return name + RETAINED_SUFFIX, true
+	case RETAINED_DROP:
+		log.Printf("[MQTT] Dropped retained message from topic: %q\n",
+			msg.Topic())
+		return name, false
+	}
+	return name, true
+}
+
+// dispatcher sends the received messages for record, each under the name
+// and retained policy of the first enabled topic matching it in the
+// configuration order. Overlapping filters record a message only once.
+type dispatcher struct {
+	policy string
+	rec    recorderFn
+	mu     sync.Mutex
+	topics []topic
+}
+
+// newDispatcher creates the dispatcher for the topics of the supplied
+// configuration, sending the messages to the supplied recorder.
+func newDispatcher(m cfg, rec recorderFn) *dispatcher {
+	return &dispatcher{
+		policy: m.Retained,
+		rec:    rec,
+		topics: m.subscribeTopics(),
+	}
+}
+
+// add includes the supplied topic subscribed at runtime, after the
+// configured topics unless it replaces one with the same filter.
+func (d *dispatcher) add(t topic) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.topics {
+		if d.topics[i].Filter == t.Filter {
+			d.topics[i] = t
+			return
+		}
+	}
+	d.topics = append(d.topics, t)
+}
+
+// remove leaves out the topic with the supplied filter.
+func (d *dispatcher) remove(filter string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.topics {
+		if d.topics[i].Filter == filter {
+			d.topics = append(d.topics[:i], d.topics[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns the first enabled topic matching the supplied topic name.
+func (d *dispatcher) match(name string) (topic, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, t := range d.topics {
+		if t.Enabled && topicMatches(t.Filter, name) {
+			return t, true
+		}
+	}
+	return topic{}, false
+}
+
+// handle sends the supplied message for record. Messages matching none
+// of the topics are recorded under their topic name.
+func (d *dispatcher) handle(msg mqtt.Message) {
+	log.Printf("[MQTT] Received message: %q from topic: %q\n",
+		msg.Payload(), msg.Topic())
+	name, policy := msg.Topic(), d.policy
+	if t, ok := d.match(msg.Topic()); ok {
+		name, policy = t.Name(msg.Topic()), t.Retained
+	}
+	name, ok := applyRetained(policy, name, msg)
+	if !ok {
+		return
+	}
+	// Send for Record
+	d.rec(name, string(msg.Payload()), newMsgMeta(msg))
+}
+
+// batchTopics splits the enabled topics into batches of the supplied size.
+func batchTopics(topics []topic, size int) [][]topic {
+	if size <= 0 {
+		size = SUBSCRIBE_BATCH
+	}
+	var batches [][]topic
+	var batch []topic
+	for _, t := range topics {
+		if !t.Enabled {
+			continue
+		}
+		batch = append(batch, t)
+		if len(batch) == size {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// subscribeAllMQTT helps to create subscriptions to all the enabled topics
+// for the client, sending them in batches of the supplied size per
+// SUBSCRIBE packet. The received messages go to the default publish
+// handler. It returns the result for each topic filter.
+func subscribeAllMQTT(client mqtt.Client, topics []topic,
+	size int) map[string]error {
+	res := make(map[string]error)
+	for _, batch := range batchTopics(topics, size) {
+		if client == nil {
+			for _, t := range batch {
+				res[t.Filter] = fmt.Errorf("no client")
+			}
+			continue
+		}
+		filters := make(map[string]byte, len(batch))
+		for _, t := range batch {
+			filters[t.Filter] = t.QoS
+		}
+		token := client.SubscribeMultiple(filters, nil)
+		token.Wait()
+		for _, t := range batch {
+			var err error
+			if token.Error() != nil {
+				err = fmt.Errorf("failed to subscribe to %q:\n %v",
+					t.Filter, token.Error())
+			} else if st, ok := token.(*mqtt.SubscribeToken); ok {
+				err = checkSubAck(t, st.Result())
+			}
+			if err == nil {
+				log.Printf("[MQTT] Subscribed to topic: %q QoS: %d\n",
+					t.Filter, t.QoS)
+			}
+			res[t.Filter] = err
+		}
+	}
+	return res
+}
+
+// subscribeMQTT helps to create subscription to the supplied topic
+// for the client. Disabled topics are skipped.
+func subscribeMQTT(client mqtt.Client, t topic) error {
+	if client == nil {
+		return fmt.Errorf("no client")
+	}
+	return subscribeAllMQTT(client, []topic{t}, 1)[t.Filter]
+}
@@ -0,0 +1,507 @@
+// mqtt5.go - MQTT 5 Functionality
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// MQTT 5 Functionality
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Default upper limit for the wait between reconnection attempts
+	RECONNECT_MAX_INTERVAL = 10 * time.Minute
+	// Time to wait for the Broker to acknowledge the subscriptions
+	SUBSCRIBE_TIMEOUT = 30 * time.Second
+	// Prefix of the shared subscription filters
+	SHARE_PREFIX = "$share/"
+	// Longest session expiry, which never expires
+	SESSION_EXPIRY_MAX = 0xFFFFFFFF
+	// Files of the MQTT 5 persistent session store
+	SESSION_CLIENT_PREFIX = "client5-"
+	SESSION_SERVER_PREFIX = "server5-"
+	SESSION_EXTENSION     = ".pkt"
+)
+
+// message5 adapts a received MQTT 5 message to the mqtt.Message interface
+// so that the same record handling applies to both protocols.
+type message5 struct {
+	p *paho.Publish
+}
+
+func (m *message5) Duplicate() bool   { return m.p.Duplicate() }
+func (m *message5) Qos() byte         { return m.p.QoS }
+func (m *message5) Retained() bool    { return m.p.Retain }
+func (m *message5) Topic() string     { return m.p.Topic }
+func (m *message5) MessageID() uint16 { return m.p.PacketID }
+func (m *message5) Payload() []byte   { return m.p.Payload }
+func (m *message5) Ack()              {}
+
+// properties adds the MQTT 5 properties of the message into the metadata.
+func (m *message5) properties(meta *msgMeta) {
+	p := m.p.Properties
+	if p == nil {
+		return
+	}
+	meta.ContentType = p.ContentType
+	meta.CorrelationData = p.CorrelationData
+	meta.MessageExpiry = p.MessageExpiry
+	meta.ResponseTopic = p.ResponseTopic
+	for _, u := range p.User {
+		meta.UserProperties = append(meta.UserProperties,
+			[2]string{u.Key, u.Value})
+	}
+}
+
+// checkMQTT5 reports the settings that are not available with MQTT 5.
+func checkMQTT5(m cfg) error {
+	switch {
+	case usesProxy(m.Proxy):
+		return fmt.Errorf("proxy is not supported with MQTT 5")
+	case len(m.Status.Topic) > 0:
+		return fmt.Errorf("status topic is not supported with MQTT 5")
+	case len(m.Control.Topic) > 0:
+		return fmt.Errorf("control topic is not supported with MQTT 5")
+	case m.Connection.PingTimeout > 0:
+		return fmt.Errorf("ping timeout is not supported with MQTT 5")
+	case m.Connection.WriteTimeout > 0:
+		return fmt.Errorf("write timeout is not supported with MQTT 5")
+	case m.MQTT5.RetainHandling > 2:
+		return fmt.Errorf("invalid retain handling %d", m.MQTT5.RetainHandling)
+	}
+	for _, t := range m.subscribeTopics() {
+		if !t.Enabled {
+			continue
+		}
+		// No Local on a shared subscription is a Protocol Error
+		if m.MQTT5.NoLocal && strings.HasPrefix(t.Filter, SHARE_PREFIX) {
+			return fmt.Errorf("no local is not allowed for the shared "+
+				"subscription %q", t.Filter)
+		}
+		// Live messages keep their retain flag, so would be marked or
+		// dropped as well
+		if m.MQTT5.RetainAsPublished && t.Retained != RETAINED_RECORD &&
+			len(t.Retained) > 0 {
+			return fmt.Errorf("retain as published is not allowed with "+
+				"the retained policy %q of %q", t.Retained, t.Filter)
+		}
+	}
+	return nil
+}
+
+// topicMatches reports if the supplied topic name matches the filter,
+// including the shared subscription filters.
+func topicMatches(filter, name string) bool {
+	if strings.HasPrefix(filter, SHARE_PREFIX) {
+		_, filter, _ = strings.Cut(filter[len(SHARE_PREFIX):], "/")
+	}
+	// Wildcards at the start do not match the "$" topics
+	if strings.HasPrefix(name, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	fl := strings.Split(filter, "/")
+	nl := strings.Split(name, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(nl) || (f != "+" && f != nl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(nl)
+}
+
+// backoff5 creates the exponential wait between the connection attempts.
+func backoff5(initial, max time.Duration) autopaho.Backoff {
+	return func(attempt int) time.Duration {
+		if attempt <= 0 {
+			return 0
+		}
+		delay := initial
+		for i := 1; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		return min(delay, max)
+	}
+}
+
+// setupMQTT5 sets up the options for the MQTT 5 connection from the
+// supplied configuration and returns the same. The received messages and
+// the connection markers are recorded through the dispatcher.
+func setupMQTT5(m cfg, cancel context.CancelFunc,
+	d *dispatcher) (autopaho.ClientConfig, error) {
+	var c autopaho.ClientConfig
+	rec := d.rec
+	if err := checkMQTT5(m); err != nil {
+		return c, err
+	}
+	// Brokers in the order of failover
+	for _, b := range m.brokerList() {
+		u, err := url.Parse(b)
+		if err != nil {
+			return c, fmt.Errorf("invalid broker address %q:\n %v", b, err)
+		}
+		c.ServerUrls = append(c.ServerUrls, u)
+	}
+	c.ClientID = m.ClientID
+	c.ConnectUsername = m.Username
+	c.ConnectPassword = []byte(m.Password)
+	// Fresh password before every connection
+	if usesCredentials(m.Credentials) {
+		if err := checkCredentials(m.Credentials); err != nil {
+			return c, err
+		}
+		provider := credentialsProvider(m)
+		c.ConnectPacketBuilder = func(cp *paho.Connect,
+			u *url.URL) (*paho.Connect, error) {
+			username, password := provider()
+			cp.Username = username
+			cp.UsernameFlag = len(username) > 0
+			cp.Password = []byte(password)
+			cp.PasswordFlag = len(password) > 0
+			return cp, nil
+		}
+	}
+	// If CA, Client Certificate files or TLS options are available
+	if usesTLS(m) {
+		tlsCfg, err := setupTLS(m)
+		if err != nil {
+			return c, err
+		}
+		c.TlsCfg = tlsCfg
+	}
+	// WebSocket Options
+	if len(m.WebSocket.Headers) > 0 {
+		h := make(http.Header)
+		for k, v := range m.WebSocket.Headers {
+			h.Set(k, v)
+		}
+		c.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(*url.URL, *tls.Config) http.Header { return h },
+		}
+	}
+	if m.WebSocket.ReadBufferSize < 0 || m.WebSocket.WriteBufferSize < 0 {
+		return c, fmt.Errorf("invalid websocket buffer sizes %d, %d",
+			m.WebSocket.ReadBufferSize, m.WebSocket.WriteBufferSize)
+	}
+	if m.WebSocket.ReadBufferSize > 0 || m.WebSocket.WriteBufferSize > 0 ||
+		m.WebSocket.NoProxy {
+		if c.WebSocketCfg == nil {
+			c.WebSocketCfg = &autopaho.WebSocketConfig{}
+		}
+		c.WebSocketCfg.Dialer = func(*url.URL, *tls.Config) *websocket.Dialer {
+			d := *websocket.DefaultDialer
+			d.ReadBufferSize = m.WebSocket.ReadBufferSize
+			d.WriteBufferSize = m.WebSocket.WriteBufferSize
+			if m.WebSocket.NoProxy {
+				d.Proxy = nil
+			}
+			return &d
+		}
+	}
+
+	// Keep Alive and Timeouts with the same validation and defaults
+	opts := mqtt.NewClientOptions()
+	if err := setupConnection(opts, m.Connection); err != nil {
+		return c, err
+	}
+	c.KeepAlive = uint16(opts.KeepAlive)
+	c.ConnectTimeout = opts.ConnectTimeout
+
+	// Sessions
+	c.CleanStartOnInitialConnection = !m.Session.Persistent
+	if m.Session.Persistent {
+		// Else the Broker ends the session upon disconnection
+		if m.MQTT5.SessionExpiry < duration(time.Second) {
+			return c, fmt.Errorf("persistent session needs the " +
+				"MQTT5 SessionExpiry of at least a second")
+		}
+		c.SessionExpiryInterval = uint32(min(
+			time.Duration(m.MQTT5.SessionExpiry)/time.Second,
+			SESSION_EXPIRY_MAX))
+		// In-flight messages on disk to survive restarts
+		dir, err := sessionStoreDir(m)
+		if err != nil {
+			return c, err
+		}
+		client, err := file.New(dir, SESSION_CLIENT_PREFIX, SESSION_EXTENSION)
+		if err != nil {
+			return c, fmt.Errorf("failed to open session store %q:\n %v",
+				dir, err)
+		}
+		server, err := file.New(dir, SESSION_SERVER_PREFIX, SESSION_EXTENSION)
+		if err != nil {
+			return c, fmt.Errorf("failed to open session store %q:\n %v",
+				dir, err)
+		}
+		c.Session = state.New(client, server)
+		log.Printf("[MQTT] Persistent session stored in %q\n", dir)
+	}
+
+	// Automatic Reconnection
+	maxInterval := time.Duration(m.Reconnect.MaxInterval)
+	if maxInterval <= 0 {
+		maxInterval = RECONNECT_MAX_INTERVAL
+	}
+	c.ReconnectBackoff = backoff5(RETRY_INITIAL_DELAY, maxInterval)
+	c.Errors = log.New(log.Writer(), "[MQTT][ERROR] ",
+		log.Flags()|log.Lmsgprefix)
+
+	// Set Callbacks
+	c.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
+		func(pr paho.PublishReceived) (bool, error) {
+			d.handle(&message5{p: pr.Packet})
+			return true, nil
+		},
+	}
+	var connected atomic.Bool
+	var takeover takeoverDetector
+	var resubscribe sync.Mutex
+	// Broker of the latest connection attempt
+	var broker atomic.Value
+	broker.Store("")
+	build := c.ConnectPacketBuilder
+	c.ConnectPacketBuilder = func(cp *paho.Connect,
+		u *url.URL) (*paho.Connect, error) {
+		broker.Store(u.Redacted())
+		if build != nil {
+			return build(cp, u)
+		}
+		return cp, nil
+	}
+	c.OnConnectionUp = func(cm *autopaho.ConnectionManager,
+		ca *paho.Connack) {
+		takeover.connected(time.Now())
+		// First Connection - Subscriptions are done by the caller
+		if !connected.Swap(true) {
+			log.Printf("[MQTT] Connected to Broker %s with MQTT 5\n",
+				broker.Load())
+			return
+		}
+		log.Printf("[MQTT] Reconnected to Broker %s with MQTT 5\n",
+			broker.Load())
+		rec(MARKER_TOPIC, fmt.Sprintf("reconnected: %s", broker.Load()), nil)
+		// Restore the Subscriptions without blocking the connection
+		go func() {
+			resubscribe.Lock()
+			defer resubscribe.Unlock()
+			res := subscribeAllMQTT5(cm, m.subscribeTopics(),
+				m.Subscribe.BatchSize, m.MQTT5)
+			for filter, err := range res {
+				if err != nil {
+					log.Printf("[MQTT][ERROR] Failed to resubscribe to %q\n %v\n",
+						filter, err)
+				}
+			}
+		}()
+	}
+	c.OnConnectionDown = func() bool {
+		log.Println("[MQTT] Connect lost")
+		n := takeover.lost(time.Now())
+		if n >= TAKEOVER_COUNT || (n > 0 && m.Reconnect.Disabled) {
+			log.Printf("[MQTT][ERROR] Connection lost %d time(s) right "+
+				"after connecting - another client is probably using "+
+				"the Client ID %q (session takeover)\n", n, m.ClientID)
+			rec(MARKER_TOPIC, fmt.Sprintf("session takeover suspected: %q",
+				m.ClientID), nil)
+		}
+		if m.Reconnect.Disabled {
+			cancel()
+			return false
+		}
+		rec(MARKER_TOPIC, "disconnected", nil)
+		return true
+	}
+	c.OnServerDisconnect = func(d *paho.Disconnect) {
+		reason := ""
+		if d.Properties != nil {
+			reason = d.Properties.ReasonString
+		}
+		log.Printf("[MQTT] Disconnected by Broker, reason code 0x%02X %s\n",
+			d.ReasonCode, reason)
+	}
+	c.OnConnectError = func(err error) {
+		log.Printf("[MQTT] Connection attempt failed: %v\n", err)
+	}
+	return c, nil
+}
+
+// connectMQTT5 starts the MQTT 5 connection and waits for it to come up,
+// retrying the connection as per the retry settings. It stops early when
+// the context gets cancelled.
+func connectMQTT5(ctx context.Context, c autopaho.ClientConfig,
+	r connectRetryOptions) (*autopaho.ConnectionManager, error) {
+	delay := time.Duration(r.InitialDelay)
+	if delay <= 0 {
+		delay = RETRY_INITIAL_DELAY
+	}
+	maxDelay := time.Duration(r.MaxDelay)
+	if maxDelay <= 0 {
+		maxDelay = RETRY_MAX_DELAY
+	}
+	var up atomic.Bool
+	var attempts atomic.Int32
+	failed := make(chan error, 1)
+	reconnect := c.ReconnectBackoff
+	initial := backoff5(delay, maxDelay)
+	c.ReconnectBackoff = func(attempt int) time.Duration {
+		if up.Load() {
+			return reconnect(attempt)
+		}
+		return initial(attempt)
+	}
+	onConnectError := c.OnConnectError
+	c.OnConnectError = func(err error) {
+		if onConnectError != nil {
+			onConnectError(err)
+		}
+		if up.Load() {
+			return
+		}
+		n := int(attempts.Add(1))
+		if !r.Enabled || (r.MaxAttempts > 0 && n >= r.MaxAttempts) {
+			select {
+			case failed <- fmt.Errorf("failed to connect to mqtt after %d "+
+				"attempt(s):\n %v", n, err):
+			default:
+			}
+		}
+	}
+
+	// Connection lives till disconnectMQTT5
+	cm, err := autopaho.NewConnection(context.Background(), c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mqtt:\n %v", err)
+	}
+	waitCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	connected := make(chan error, 1)
+	go func() { connected <- cm.AwaitConnection(waitCtx) }()
+	select {
+	case err = <-connected:
+		if err == nil {
+			up.Store(true)
+			return cm, nil
+		}
+		err = fmt.Errorf("connection cancelled: %v", err)
+	case err = <-failed:
+	}
+	disconnectMQTT5(cm, 20)
+	return nil, err
+}
+
+// disconnectMQTT5 helps to disconnect the MQTT 5 connection within a given
+// time period supplied in number of milliseconds.
+func disconnectMQTT5(cm *autopaho.ConnectionManager, ms uint) error {
+	if cm == nil {
+		return fmt.Errorf("no client")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(ms)*time.Millisecond)
+	defer cancel()
+	return cm.Disconnect(ctx)
+}
+
+// checkSubAck5 checks the reason code at the index of the topic in the
+// SUBACK, which may be missing or short when the subscription failed.
+func checkSubAck5(t topic, i int, sa *paho.Suback, err error) error {
+	result := make(map[string]byte)
+	if sa != nil && i < len(sa.Reasons) {
+		result[t.Filter] = sa.Reasons[i]
+	} else if err != nil {
+		return fmt.Errorf("failed to subscribe to %q:\n %v", t.Filter, err)
+	}
+	return checkSubAck(t, result)
+}
+
+// subscribeAllMQTT5 subscribes to the supplied topics in batches of the
+// given size with the MQTT 5 subscription options. The messages are
+// recorded through the message handler of the connection. It returns
+// the result for each topic filter. Disabled topics are skipped.
+func subscribeAllMQTT5(cm *autopaho.ConnectionManager, topics []topic,
+	size int, o mqtt5Options) map[string]error {
+	res := make(map[string]error)
+	for _, batch := range batchTopics(topics, size) {
+		s := &paho.Subscribe{}
+		for _, t := range batch {
+			s.Subscriptions = append(s.Subscriptions, paho.SubscribeOptions{
+				Topic:             t.Filter,
+				QoS:               t.QoS,
+				NoLocal:           o.NoLocal,
+				RetainHandling:    o.RetainHandling,
+				RetainAsPublished: o.RetainAsPublished,
+			})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			SUBSCRIBE_TIMEOUT)
+		sa, err := cm.Subscribe(ctx, s)
+		cancel()
+		for i, t := range batch {
+			res[t.Filter] = checkSubAck5(t, i, sa, err)
+			if res[t.Filter] == nil {
+				log.Printf("[MQTT] Subscribed to topic: %q QoS: %d\n",
+					t.Filter, t.QoS)
+			}
+		}
+	}
+	return res
+}
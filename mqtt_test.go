@@ -48,16 +48,72 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 // dummyRecorderFn is a mock for the recorderFn in purely logging type function
 func dummyRecorderFn(t *testing.T) recorderFn {
-	return func(s1, s2 string) {
-		t.Logf("Parameters: %q, %q", s1, s2)
+	return func(s1, s2 string, meta *msgMeta) {
+		t.Logf("Parameters: %q, %q, %+v", s1, s2, meta)
+	}
+}
+
+const (
+	TEST_CERT_FILE = "test-client.crt"
+	TEST_KEY_FILE  = "test-client.key"
+	TEST_STORE_DIR = "test-store"
+)
+
+// writeTestKeyPair generates a self-signed client certificate and key
+// for the TLS related test cases.
+func writeTestKeyPair(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-mli-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+	err = os.WriteFile(TEST_CERT_FILE, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	err = os.WriteFile(TEST_KEY_FILE, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write key: %v", err)
 	}
 }
 
@@ -86,6 +142,7 @@ func Test_setupMQTT(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
+		wantErr bool
 		checkFn func(t *testing.T, opts *mqtt.ClientOptions)
 	}{
 		{
@@ -132,12 +189,488 @@ func Test_setupMQTT(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Config with Failover Brokers",
+			args: args{
+				m: cfg{
+					ADDR: "tcp://primary:1883",
+					Brokers: []string{
+						"tcp://standby:1883",
+						"tcp://primary:1883",
+					},
+					ClientID: "go-mli-mqtt-test",
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if len(opts.Servers) != 2 {
+					t.Fatalf("failed to get correct servers: %v",
+						opts.Servers)
+				}
+				if opts.Servers[0].Host != "primary:1883" ||
+					opts.Servers[1].Host != "standby:1883" {
+					t.Errorf("failed to get correct server order: %v",
+						opts.Servers)
+				}
+			},
+		},
+		{
+			name: "Config with Reconnect Options",
+			args: args{
+				m: cfg{
+					ADDR:     ":1883",
+					ClientID: "go-mli-mqtt-test",
+					Reconnect: reconnectOptions{
+						MaxInterval: duration(30 * time.Second),
+					},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if !opts.AutoReconnect {
+					t.Errorf("failed to enable auto reconnect")
+				}
+				if opts.MaxReconnectInterval != 30*time.Second {
+					t.Errorf("failed to get correct max reconnect interval: %v",
+						opts.MaxReconnectInterval)
+				}
+			},
+		},
+		{
+			name: "Config with Reconnect Disabled",
+			args: args{
+				m: cfg{
+					ADDR:      ":1883",
+					ClientID:  "go-mli-mqtt-test",
+					Reconnect: reconnectOptions{Disabled: true},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.AutoReconnect {
+					t.Errorf("failed to disable auto reconnect")
+				}
+			},
+		},
+		{
+			name: "Config with Credentials Provider",
+			args: args{
+				m: cfg{
+					ADDR:        ":1883",
+					Username:    "user",
+					Credentials: credentialsOptions{File: "token"},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.CredentialsProvider == nil {
+					t.Errorf("failed to set the credentials provider")
+				}
+			},
+		},
+		{
+			name: "Negative Test - Credentials Command and File",
+			args: args{
+				m: cfg{
+					ADDR: ":1883",
+					Credentials: credentialsOptions{
+						Command: []string{"get-token"},
+						File:    "token",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with MQTT 3.1",
+			args: args{
+				m: cfg{ADDR: ":1883", ProtocolVersion: PROTOCOL_MQTT31},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.ProtocolVersion != PROTOCOL_MQTT31 {
+					t.Errorf("failed to set the protocol version: %d",
+						opts.ProtocolVersion)
+				}
+			},
+		},
+		{
+			name: "Negative Test - MQTT 5",
+			args: args{
+				m: cfg{ADDR: ":1883", ProtocolVersion: PROTOCOL_MQTT5},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Unknown Protocol Version",
+			args: args{
+				m: cfg{ADDR: ":1883", ProtocolVersion: 7},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with Connection Options",
+			args: args{
+				m: cfg{
+					ADDR:     ":1883",
+					ClientID: "go-mli-mqtt-test",
+					Connection: connectionOptions{
+						KeepAlive:      duration(15 * time.Second),
+						PingTimeout:    duration(5 * time.Second),
+						ConnectTimeout: duration(20 * time.Second),
+						WriteTimeout:   duration(3 * time.Second),
+						ChannelDepth:   1000,
+					},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.KeepAlive != 15 || opts.PingTimeout != 5*time.Second {
+					t.Errorf("failed to get correct keep alive: %v, %v",
+						opts.KeepAlive, opts.PingTimeout)
+				}
+				if opts.ConnectTimeout != 20*time.Second ||
+					opts.WriteTimeout != 3*time.Second {
+					t.Errorf("failed to get correct timeouts: %v, %v",
+						opts.ConnectTimeout, opts.WriteTimeout)
+				}
+			},
+		},
+		{
+			name: "Config with Default Connection Options",
+			args: args{
+				m: cfg{
+					ADDR:     ":1883",
+					ClientID: "go-mli-mqtt-test",
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.KeepAlive != 30 || opts.PingTimeout != 10*time.Second ||
+					opts.ConnectTimeout != 30*time.Second ||
+					opts.WriteTimeout != 0 {
+					t.Errorf("failed to keep the defaults: %v, %v, %v, %v",
+						opts.KeepAlive, opts.PingTimeout,
+						opts.ConnectTimeout, opts.WriteTimeout)
+				}
+			},
+		},
+		{
+			name: "Negative Test - Keep Alive not in Seconds",
+			args: args{
+				m: cfg{
+					ADDR: ":1883",
+					Connection: connectionOptions{
+						KeepAlive: duration(1500 * time.Millisecond),
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Keep Alive too Long",
+			args: args{
+				m: cfg{
+					ADDR: ":1883",
+					Connection: connectionOptions{
+						KeepAlive: duration(24 * time.Hour),
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with Short Keep Alive",
+			args: args{
+				m: cfg{
+					ADDR: ":1883",
+					Connection: connectionOptions{
+						KeepAlive: duration(5 * time.Second),
+					},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.KeepAlive != 5 ||
+					opts.PingTimeout != 2500*time.Millisecond {
+					t.Errorf("failed to shorten the ping timeout: %v, %v",
+						opts.KeepAlive, opts.PingTimeout)
+				}
+			},
+		},
+		{
+			name: "Negative Test - Ping Timeout beyond Keep Alive",
+			args: args{
+				m: cfg{
+					ADDR: ":1883",
+					Connection: connectionOptions{
+						KeepAlive:   duration(5 * time.Second),
+						PingTimeout: duration(5 * time.Second),
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Invalid Channel Depth",
+			args: args{
+				m: cfg{
+					ADDR:       ":1883",
+					Connection: connectionOptions{ChannelDepth: -1},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with Persistent Session",
+			args: args{
+				m: cfg{
+					ADDR:     ":1883",
+					ClientID: "go-mli-mqtt-test",
+					Session: sessionOptions{
+						Persistent: true,
+						StoreDir:   TEST_STORE_DIR,
+					},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.CleanSession {
+					t.Errorf("failed to disable clean session")
+				}
+				if _, ok := opts.Store.(*mqtt.FileStore); !ok {
+					t.Errorf("failed to get the file store: %T", opts.Store)
+				}
+				_, err := os.Stat(TEST_STORE_DIR + "/go-mli-mqtt-test")
+				if err != nil {
+					t.Errorf("failed to create the store directory: %v", err)
+				}
+			},
+		},
+		{
+			name: "Negative Test - Persistent Session without ClientID",
+			args: args{
+				m: cfg{
+					ADDR:    ":1883",
+					Session: sessionOptions{Persistent: true},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with WebSocket Options",
+			args: args{
+				m: cfg{
+					ADDR:     "wss://broker.local:443/mqtt",
+					ClientID: "go-mli-mqtt-test",
+					WebSocket: websocketOptions{
+						Headers:         map[string]string{"x-api-key": "k1"},
+						ReadBufferSize:  8192,
+						WriteBufferSize: 1024,
+						NoProxy:         true,
+					},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.Servers[0].Path != "/mqtt" {
+					t.Errorf("failed to get correct path: %q",
+						opts.Servers[0].Path)
+				}
+				if opts.HTTPHeaders.Get("X-Api-Key") != "k1" {
+					t.Errorf("failed to get correct headers: %v",
+						opts.HTTPHeaders)
+				}
+				ws := opts.WebsocketOptions
+				if ws == nil || ws.ReadBufferSize != 8192 ||
+					ws.WriteBufferSize != 1024 {
+					t.Fatalf("failed to get correct buffer sizes: %+v", ws)
+				}
+				if u, err := ws.Proxy(nil); u != nil || err != nil {
+					t.Errorf("failed to disable the proxy: %v, %v", u, err)
+				}
+			},
+		},
+		{
+			name: "Negative Test - Invalid WebSocket Buffer",
+			args: args{
+				m: cfg{
+					ADDR:      "ws://broker.local:80",
+					WebSocket: websocketOptions{ReadBufferSize: -1},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with Proxy",
+			args: args{
+				m: cfg{
+					ADDR:     "ssl://broker.local:8883",
+					ClientID: "go-mli-mqtt-test",
+					Proxy:    proxyOptions{URL: "socks5://proxy.local:1080"},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.CustomOpenConnectionFn == nil {
+					t.Errorf("failed to set the proxy connection")
+				}
+				u, err := opts.WebsocketOptions.Proxy(&http.Request{
+					URL: opts.Servers[0],
+				})
+				if err != nil || u == nil || u.Host != "proxy.local:1080" {
+					t.Errorf("failed to set the websocket proxy: %v, %v",
+						u, err)
+				}
+			},
+		},
+		{
+			name: "Negative Test - Invalid Proxy",
+			args: args{
+				m: cfg{
+					ADDR:  "tcp://broker.local:1883",
+					Proxy: proxyOptions{URL: "gopher://proxy.local"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - HTTPS Proxy for WebSocket",
+			args: args{
+				m: cfg{
+					ADDR:  "wss://broker.local:443/mqtt",
+					Proxy: proxyOptions{URL: "https://proxy.local"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with Client Certificates",
+			args: args{
+				m: cfg{
+					ADDR:           "ssl://:8883",
+					ClientID:       "go-mli-mqtt-test",
+					ClientCertFile: TEST_CERT_FILE,
+					ClientKeyFile:  TEST_KEY_FILE,
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.TLSConfig == nil ||
+					len(opts.TLSConfig.Certificates) != 1 {
+					t.Errorf("failed to load the client certificate")
+				}
+			},
+		},
+		{
+			name: "Negative Test - Client Certificate without Key",
+			args: args{
+				m: cfg{
+					ADDR:           "ssl://:8883",
+					ClientID:       "go-mli-mqtt-test",
+					ClientCertFile: TEST_CERT_FILE,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Mismatched Client Certificate and Key",
+			args: args{
+				m: cfg{
+					ADDR:           "ssl://:8883",
+					ClientID:       "go-mli-mqtt-test",
+					ClientCertFile: TEST_KEY_FILE,
+					ClientKeyFile:  TEST_CERT_FILE,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Missing CA File",
+			args: args{
+				m: cfg{
+					ADDR:     "ssl://:8883",
+					ClientID: "go-mli-mqtt-test",
+					CAFile:   "build/missing-ca.crt",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Config with TLS Options",
+			args: args{
+				m: cfg{
+					ADDR:     "ssl://:8883",
+					ClientID: "go-mli-mqtt-test",
+					CAFile:   TEST_CERT_FILE,
+					TLS: tlsOptions{
+						ServerName:     "broker.local",
+						MinVersion:     "1.2",
+						UseSystemRoots: true,
+						CipherSuites: []string{
+							"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+						},
+					},
+				},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				c := opts.TLSConfig
+				if c == nil || c.RootCAs == nil {
+					t.Fatalf("failed to load the CA file")
+				}
+				if c.ServerName != "broker.local" {
+					t.Errorf("failed to get correct server name: %q",
+						c.ServerName)
+				}
+				if c.MinVersion != tls.VersionTLS12 {
+					t.Errorf("failed to get correct min version: %x",
+						c.MinVersion)
+				}
+				if len(c.CipherSuites) != 1 || c.CipherSuites[0] !=
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+					t.Errorf("failed to get correct cipher suites: %v",
+						c.CipherSuites)
+				}
+			},
+		},
+		{
+			name: "Negative Test - Invalid CA PEM",
+			args: args{
+				m: cfg{
+					ADDR:     "ssl://:8883",
+					ClientID: "go-mli-mqtt-test",
+					CAFile:   TEST_KEY_FILE,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Unknown TLS Version",
+			args: args{
+				m: cfg{
+					ADDR:     "ssl://:8883",
+					ClientID: "go-mli-mqtt-test",
+					TLS:      tlsOptions{MinVersion: "2.0"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Unknown Cipher Suite",
+			args: args{
+				m: cfg{
+					ADDR:     "ssl://:8883",
+					ClientID: "go-mli-mqtt-test",
+					TLS:      tlsOptions{CipherSuites: []string{"NOPE"}},
+				},
+			},
+			wantErr: true,
+		},
 	}
+	writeTestKeyPair(t)
+	defer os.Remove(TEST_CERT_FILE)
+	defer os.Remove(TEST_KEY_FILE)
+	defer os.RemoveAll(TEST_STORE_DIR)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			_, cancel := context.WithCancel(context.Background())
 			rec := dummyRecorderFn(t)
-			got := setupMQTT(tt.args.m, cancel, rec)
+			got, err := setupMQTT(tt.args.m, cancel, newDispatcher(tt.args.m, rec))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("setupMQTT() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
 			tt.checkFn(t, got)
 		})
 	}
@@ -171,10 +704,10 @@ func Test_connectMQTT(t *testing.T) {
 				optsFn: func(t *testing.T) *mqtt.ClientOptions {
 					_, cancel := context.WithCancel(context.Background())
 					rec := dummyRecorderFn(t)
-					got := setupMQTT(cfg{
+					got, _ := setupMQTT(cfg{
 						ADDR:     "mqtt://test.mosquitto.org:1883",
 						ClientID: "go-mli-testing-connectMQTT",
-					}, cancel, rec)
+					}, cancel, newDispatcher(cfg{}, rec))
 					return got
 				},
 			},
@@ -185,12 +718,12 @@ func Test_connectMQTT(t *testing.T) {
 				optsFn: func(t *testing.T) *mqtt.ClientOptions {
 					_, cancel := context.WithCancel(context.Background())
 					rec := dummyRecorderFn(t)
-					got := setupMQTT(cfg{
+					got, _ := setupMQTT(cfg{
 						ADDR:     "mqtt://test.mosquitto.org:1884",
 						ClientID: "go-mli-testing-connectMQTT",
 						Username: "rw",
 						Password: "readwrite",
-					}, cancel, rec)
+					}, cancel, newDispatcher(cfg{}, rec))
 					return got
 				},
 			},
@@ -201,12 +734,12 @@ func Test_connectMQTT(t *testing.T) {
 				optsFn: func(t *testing.T) *mqtt.ClientOptions {
 					_, cancel := context.WithCancel(context.Background())
 					rec := dummyRecorderFn(t)
-					got := setupMQTT(cfg{
+					got, _ := setupMQTT(cfg{
 						ADDR:     "mqtt://test.mosquittoi.org:1884",
 						ClientID: "go-mli-testing-connectMQTT",
 						Username: "rw",
 						Password: "readwrite",
-					}, cancel, rec)
+					}, cancel, newDispatcher(cfg{}, rec))
 					return got
 				},
 			},
@@ -218,12 +751,12 @@ func Test_connectMQTT(t *testing.T) {
 				optsFn: func(t *testing.T) *mqtt.ClientOptions {
 					_, cancel := context.WithCancel(context.Background())
 					rec := dummyRecorderFn(t)
-					got := setupMQTT(cfg{
+					got, _ := setupMQTT(cfg{
 						ADDR:     "mqtt://test.mosquitto.org:1884",
 						ClientID: "go-mli-testing-connectMQTT",
 						Username: "rw1",
 						Password: "readwrite",
-					}, cancel, rec)
+					}, cancel, newDispatcher(cfg{}, rec))
 					return got
 				},
 			},
@@ -236,12 +769,12 @@ func Test_connectMQTT(t *testing.T) {
 					_, cancel := context.WithCancel(context.Background())
 					rec := dummyRecorderFn(t)
 
-					got := setupMQTT(cfg{
+					got, _ := setupMQTT(cfg{
 						ADDR:     "mqtts://broker.emqx.io:8883",
 						ClientID: "go-mli-testing-connectMQTT",
 						Username: "emqx",
 						Password: "public",
-					}, cancel, rec)
+					}, cancel, newDispatcher(cfg{}, rec))
 					return got
 				},
 			},
@@ -253,12 +786,12 @@ func Test_connectMQTT(t *testing.T) {
 					_, cancel := context.WithCancel(context.Background())
 					rec := dummyRecorderFn(t)
 
-					got := setupMQTT(cfg{
+					got, _ := setupMQTT(cfg{
 						ADDR:     "mqtts://broker.emqx.io:8883",
 						ClientID: "go-mli-testing-connectMQTT",
 						Username: "emqx",
 						Password: "public",
-					}, cancel, rec)
+					}, cancel, newDispatcher(cfg{}, rec))
 					return got
 				},
 			},
@@ -286,3 +819,452 @@ func Test_connectMQTT(t *testing.T) {
 		})
 	}
 }
+
+func Test_connectRetryMQTT(t *testing.T) {
+	tests := []struct {
+		name    string
+		retry   connectRetryOptions
+		cancel  time.Duration
+		wantErr bool
+		maxTime time.Duration
+	}{
+		{
+			name:    "Negative Test - No Retry",
+			retry:   connectRetryOptions{},
+			wantErr: true,
+			maxTime: time.Second,
+		},
+		{
+			name: "Negative Test - Limited Attempts",
+			retry: connectRetryOptions{
+				Enabled:      true,
+				InitialDelay: duration(10 * time.Millisecond),
+				MaxDelay:     duration(20 * time.Millisecond),
+				MaxAttempts:  3,
+			},
+			wantErr: true,
+			maxTime: 2 * time.Second,
+		},
+		{
+			name: "Negative Test - Cancel Infinite Retry",
+			retry: connectRetryOptions{
+				Enabled:      true,
+				InitialDelay: duration(10 * time.Millisecond),
+			},
+			cancel:  100 * time.Millisecond,
+			wantErr: true,
+			maxTime: 2 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			opts := mqtt.NewClientOptions()
+			// Nothing should be listening on this port
+			opts.AddBroker("tcp://127.0.0.1:1")
+			opts.SetClientID("go-mli-testing-connectRetryMQTT")
+			opts.SetConnectTimeout(100 * time.Millisecond)
+			addDummyCallbacks(t, opts)
+			start := time.Now()
+			client, err := connectRetryMQTT(ctx, opts, tt.retry)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("connectRetryMQTT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > tt.maxTime {
+				t.Errorf("connectRetryMQTT() took too long: %v", elapsed)
+			}
+			if client != nil {
+				disconnectMQTT(client, 10)
+			}
+		})
+	}
+}
+
+func Test_connectRetryMQTT_CancelDuringConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	closed := make(chan bool, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := packets.ReadPacket(conn); err != nil {
+			return
+		}
+		// Accept the connection only after the cancel
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Write(conn)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			if _, err := packets.ReadPacket(conn); err != nil {
+				var ne net.Error
+				closed <- !errors.As(err, &ne) || !ne.Timeout()
+				return
+			}
+		}
+	}()
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + l.Addr().String())
+	opts.SetClientID("go-mli-testing-connectRetryMQTT")
+	addDummyCallbacks(t, opts)
+	client, err := connectRetryMQTT(ctx, opts, connectRetryOptions{})
+	if err == nil || client != nil {
+		t.Fatalf("connectRetryMQTT() = %v, %v, want cancelled", client, err)
+	}
+	select {
+	case ok := <-closed:
+		if !ok {
+			t.Errorf("connection left open after the cancel")
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("broker did not finish")
+	}
+}
+
+func Test_checkSubAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		t          topic
+		result     map[string]byte
+		wantErr    bool
+		wantDenied bool
+	}{
+		{
+			name:   "Granted QoS",
+			t:      newTopic("demo"),
+			result: map[string]byte{"demo": 1},
+		},
+		{
+			name:   "Downgraded QoS",
+			t:      topic{Filter: "alarm", QoS: 2, Enabled: true},
+			result: map[string]byte{"alarm": 1},
+		},
+		{
+			name:       "Negative Test - Denied by Broker",
+			t:          newTopic("secret/#"),
+			result:     map[string]byte{"secret/#": SUBACK_FAILURE},
+			wantErr:    true,
+			wantDenied: true,
+		},
+		{
+			name:    "Negative Test - Missing Result",
+			t:       newTopic("demo"),
+			result:  map[string]byte{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSubAck(tt.t, tt.result)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSubAck() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errSubscriptionDenied) != tt.wantDenied {
+				t.Errorf("checkSubAck() error = %v, wantDenied %v",
+					err, tt.wantDenied)
+			}
+		})
+	}
+}
+
+func Test_batchTopics(t *testing.T) {
+	topics := []topic{
+		newTopic("t1"),
+		newTopic("t2"),
+		{Filter: "t3", QoS: 1, Enabled: false},
+		newTopic("t4"),
+		newTopic("t5"),
+	}
+	tests := []struct {
+		name  string
+		size  int
+		sizes []int
+	}{
+		{
+			name:  "Batches of Two",
+			size:  2,
+			sizes: []int{2, 2},
+		},
+		{
+			name:  "Single Batch",
+			size:  10,
+			sizes: []int{4},
+		},
+		{
+			name:  "Default Batch Size",
+			size:  0,
+			sizes: []int{4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := batchTopics(topics, tt.size)
+			if len(got) != len(tt.sizes) {
+				t.Fatalf("batchTopics() = %v, want %d batches",
+					got, len(tt.sizes))
+			}
+			for i, b := range got {
+				if len(b) != tt.sizes[i] {
+					t.Errorf("batchTopics() batch %d = %v, want size %d",
+						i, b, tt.sizes[i])
+				}
+				for _, tp := range b {
+					if !tp.Enabled {
+						t.Errorf("batchTopics() has disabled topic %q",
+							tp.Filter)
+					}
+				}
+			}
+		})
+	}
+}
+
+func Test_subscribeAllMQTT(t *testing.T) {
+	topics := []topic{
+		newTopic("t1"),
+		newTopic("t2"),
+		{Filter: "off", QoS: 1, Enabled: false},
+		{Filter: "t3", QoS: 2, Enabled: true},
+		newTopic("t4"),
+		newTopic("t5"),
+	}
+	tests := []struct {
+		name        string
+		size        int
+		failFilter  string
+		wantBatches []map[string]byte
+		wantFailed  []string
+	}{
+		{
+			name: "Batches of Two",
+			size: 2,
+			wantBatches: []map[string]byte{
+				{"t1": 1, "t2": 1},
+				{"t3": 2, "t4": 1},
+				{"t5": 1},
+			},
+		},
+		{
+			name: "Default Batch Size",
+			wantBatches: []map[string]byte{
+				{"t1": 1, "t2": 1, "t3": 2, "t4": 1, "t5": 1},
+			},
+		},
+		{
+			name:       "Negative Test - Failed Batch",
+			size:       2,
+			failFilter: "t4",
+			wantBatches: []map[string]byte{
+				{"t1": 1, "t2": 1},
+				{"t3": 2, "t4": 1},
+				{"t5": 1},
+			},
+			wantFailed: []string{"t3", "t4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient()
+			c.failFilter = tt.failFilter
+			res := subscribeAllMQTT(c, topics, tt.size)
+			if !reflect.DeepEqual(c.batches, tt.wantBatches) {
+				t.Errorf("subscribeAllMQTT() batches = %v, want %v",
+					c.batches, tt.wantBatches)
+			}
+			if len(res) != 5 {
+				t.Errorf("subscribeAllMQTT() results = %v, want 5", res)
+			}
+			for f, err := range res {
+				if want := slices.Contains(tt.wantFailed, f); (err != nil) != want {
+					t.Errorf("subscribeAllMQTT() %q error = %v, want failed %v",
+						f, err, want)
+				}
+			}
+		})
+	}
+}
+
+// testMessage is a mock for the mqtt.Message received from the Broker.
+type testMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 1 }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 1 }
+func (m *testMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *testMessage) Ack()              {}
+
+func Test_applyRetained(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		retained bool
+		wantName string
+		wantOk   bool
+	}{
+		{
+			name:     "Live Message with Drop Policy",
+			policy:   RETAINED_DROP,
+			wantName: "Temp",
+			wantOk:   true,
+		},
+		{
+			name:     "Retained Message with Default Policy",
+			policy:   "",
+			retained: true,
+			wantName: "Temp",
+			wantOk:   true,
+		},
+		{
+			name:     "Retained Message with Mark Policy",
+			policy:   RETAINED_MARK,
+			retained: true,
+			wantName: "Temp" + RETAINED_SUFFIX,
+			wantOk:   true,
+		},
+		{
+			name:     "Retained Message with Drop Policy",
+			policy:   RETAINED_DROP,
+			retained: true,
+			wantName: "Temp",
+			wantOk:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &testMessage{topic: "Sensor1/Temp", payload: "21",
+				retained: tt.retained}
+			name, ok := applyRetained(tt.policy, "Temp", msg)
+			if name != tt.wantName || ok != tt.wantOk {
+				t.Errorf("applyRetained() = %q, %v, want %q, %v",
+					name, ok, tt.wantName, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_dispatcher(t *testing.T) {
+	m := cfg{
+		Retained: RETAINED_MARK,
+		Topics: []topic{
+			newTopic("Sensor1/#"),
+			{Filter: "Sensor1/Temp", QoS: 1, Alias: "Temperature", Enabled: true},
+			{Filter: "Sensor2/+", QoS: 1, Alias: "S2", Enabled: true},
+			{Filter: "Sensor3/#", QoS: 1, Alias: "S3", Enabled: false},
+		},
+	}
+	tests := []struct {
+		name   string
+		msg    *testMessage
+		add    []topic
+		remove []string
+		want   []string
+	}{
+		{
+			name: "Wildcard Filter records the Topic",
+			msg:  &testMessage{topic: "Sensor1/Hum", payload: "40"},
+			want: []string{"Sensor1/Hum"},
+		},
+		{
+			name: "Overlapping Filters record once as the first Topic",
+			msg:  &testMessage{topic: "Sensor1/Temp", payload: "21"},
+			want: []string{"Sensor1/Temp"},
+		},
+		{
+			name:   "Overlapping Filters record once after removal",
+			msg:    &testMessage{topic: "Sensor1/Temp", payload: "21"},
+			remove: []string{"Sensor1/#"},
+			want:   []string{"Temperature"},
+		},
+		{
+			name: "Alias replaces the Topic",
+			msg:  &testMessage{topic: "Sensor2/Temp", payload: "21"},
+			want: []string{"S2"},
+		},
+		{
+			name: "Disabled Topic records the Topic",
+			msg:  &testMessage{topic: "Sensor3/Temp", payload: "21"},
+			want: []string{"Sensor3/Temp"},
+		},
+		{
+			name: "Added Topic replaces the Alias",
+			msg:  &testMessage{topic: "Sensor2/Temp", payload: "21"},
+			add:  []topic{{Filter: "Sensor2/+", Alias: "T2", Enabled: true}},
+			want: []string{"T2"},
+		},
+		{
+			name: "Added Topic after the configured ones",
+			msg:  &testMessage{topic: "Sensor1/Temp", payload: "21"},
+			add:  []topic{{Filter: "+/Temp", Alias: "T", Enabled: true}},
+			want: []string{"Sensor1/Temp"},
+		},
+		{
+			name: "Retained policy of the Topic",
+			msg: &testMessage{topic: "Sensor2/Temp", payload: "21",
+				retained: true},
+			want: []string{"S2" + RETAINED_SUFFIX},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			d := newDispatcher(m, func(s1, s2 string, meta *msgMeta) {
+				got = append(got, s1)
+			})
+			for _, a := range tt.add {
+				d.add(a)
+			}
+			for _, r := range tt.remove {
+				d.remove(r)
+			}
+			d.handle(tt.msg)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("handle() recorded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_takeoverDetector(t *testing.T) {
+	var d takeoverDetector
+	now := time.Now()
+	if n := d.lost(now); n != 0 {
+		t.Errorf("lost() before connecting = %d, want 0", n)
+	}
+	for i := 1; i <= TAKEOVER_COUNT; i++ {
+		d.connected(now)
+		now = now.Add(time.Second)
+		if n := d.lost(now); n != i {
+			t.Errorf("lost() quick loss = %d, want %d", n, i)
+		}
+	}
+	// Stable connection resets the count
+	d.connected(now)
+	now = now.Add(TAKEOVER_WINDOW)
+	if n := d.lost(now); n != 0 {
+		t.Errorf("lost() after stable connection = %d, want 0", n)
+	}
+	d.connected(now)
+	if n := d.lost(now.Add(time.Second)); n != 1 {
+		t.Errorf("lost() after reset = %d, want 1", n)
+	}
+}
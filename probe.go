@@ -0,0 +1,496 @@
+// probe.go - Connection Diagnostics
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Connection Diagnostics
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// Time limit for each of the diagnostic steps
+	PROBE_TIMEOUT = 10 * time.Second
+	// Warn about the certificates expiring within this period
+	PROBE_CERT_WARN = 30 * 24 * time.Hour
+	// Suffix of the Client ID used for probing, so that a running logger
+	// with the same Client ID does not get disconnected
+	PROBE_CLIENT_SUFFIX = "-probe"
+	// Keep alive sent in the probe CONNECT packet in seconds
+	PROBE_KEEPALIVE = 30
+)
+
+// brokerPorts are the default ports for the supported Broker schemes.
+var brokerPorts = map[string]string{
+	"mqtt":     "1883",
+	"tcp":      "1883",
+	"ssl":      "8883",
+	"tls":      "8883",
+	"mqtts":    "8883",
+	"mqtt+ssl": "8883",
+	"tcps":     "8883",
+	"ws":       "80",
+	"wss":      "443",
+}
+
+// isTLSScheme reports if the supplied Broker scheme uses TLS.
+func isTLSScheme(scheme string) bool {
+	switch scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// probeStep runs a single diagnostic step and logs its result along
+// with the time taken.
+func probeStep(step string, fn func() (string, error)) error {
+	start := time.Now()
+	detail, err := fn()
+	took := time.Since(start).Round(time.Microsecond)
+	if err != nil {
+		log.Printf("[Probe][ERROR] %-10s FAILED in %v:\n %v\n", step, took, err)
+		return fmt.Errorf("%s failed:\n %v", step, err)
+	}
+	log.Printf("[Probe] %-10s OK in %v - %s\n", step, took, detail)
+	return nil
+}
+
+// probeMQTT checks the connection to every Broker of the supplied
+// configuration step by step and reports the failures.
+func probeMQTT(m cfg) error {
+	// Probing does not need the session store
+	m.Session.Persistent = false
+	if m.ProtocolVersion == PROTOCOL_MQTT5 {
+		log.Println("[Probe][WARNING] Probing with MQTT 3.1.1 instead of MQTT 5")
+		m.ProtocolVersion = PROTOCOL_MQTT311
+	}
+	opts, err := setupMQTT(m, func() {},
+		newDispatcher(m, func(string, string, *msgMeta) {}))
+	if err != nil {
+		return fmt.Errorf("failed to setup the MQTT options:\n %v", err)
+	}
+	failed := 0
+	brokers := m.brokerList()
+	for _, b := range brokers {
+		if err := probeBroker(m, opts, b); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d broker(s) failed the probe",
+			failed, len(brokers))
+	}
+	return nil
+}
+
+// probeBroker walks through the DNS resolution, TCP connection,
+// TLS handshake, MQTT connection and subscriptions for the supplied
+// Broker address.
+func probeBroker(m cfg, opts *mqtt.ClientOptions, broker string) error {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		log.Printf("[Probe][ERROR] Invalid broker address %q:\n %v\n",
+			broker, err)
+		return err
+	}
+	log.Printf("[Probe] Checking broker %q\n", uri.Redacted())
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	if uri.Scheme == "unix" {
+		addr := uri.Host
+		if len(addr) == 0 {
+			addr = uri.Path
+		}
+		err = probeStep("Socket", func() (string, error) {
+			conn, err = net.DialTimeout("unix", addr, PROBE_TIMEOUT)
+			return addr, err
+		})
+	} else {
+		conn, err = probeNetwork(m, opts, uri)
+	}
+	if err != nil {
+		return err
+	}
+	if err = probeConnect(conn, m); err != nil {
+		return err
+	}
+	return probeSubscribe(conn, m.subscribeTopics())
+}
+
+// probeNetwork checks the DNS resolution, TCP connection, TLS handshake
+// and WebSocket upgrade of the supplied Broker address and returns the
+// connection to continue with the MQTT checks.
+func probeNetwork(m cfg, opts *mqtt.ClientOptions,
+	uri *url.URL) (net.Conn, error) {
+	host := uri.Hostname()
+	port := uri.Port()
+	if len(port) == 0 {
+		p, ok := brokerPorts[uri.Scheme]
+		if !ok {
+			err := fmt.Errorf("unsupported broker scheme %q", uri.Scheme)
+			log.Printf("[Probe][ERROR] %v\n", err)
+			return nil, err
+		}
+		port = p
+	}
+	addr := net.JoinHostPort(host, port)
+
+	// DNS Resolution
+	pURL, err := resolveProxy(m.Proxy, host)
+	if err != nil {
+		log.Printf("[Probe][ERROR] %v\n", err)
+		return nil, err
+	}
+	if pURL != nil {
+		log.Printf("[Probe] Using proxy %q, the name is resolved by it\n",
+			pURL.Redacted())
+	} else {
+		err = probeStep("DNS", func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				PROBE_TIMEOUT)
+			defer cancel()
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			return strings.Join(addrs, ", "), err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// TCP Connection
+	var conn net.Conn
+	err = probeStep("TCP", func() (string, error) {
+		var d proxy.Dialer = &net.Dialer{Timeout: PROBE_TIMEOUT}
+		if pURL != nil {
+			d, err = proxy.FromURL(pURL, d)
+			if err != nil {
+				return "", fmt.Errorf("failed to setup proxy %q:\n %v",
+					pURL.Redacted(), err)
+			}
+		}
+		conn, err = d.Dial("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("connected to %s", conn.RemoteAddr()), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// TLS Handshake
+	if isTLSScheme(uri.Scheme) {
+		tlsConn, err := probeTLS(conn, opts.TLSConfig, host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// WebSocket Upgrade on a fresh connection
+	if uri.Scheme == "ws" || uri.Scheme == "wss" {
+		conn.Close()
+		conn = nil
+		err = probeStep("WebSocket", func() (string, error) {
+			dialURI := *uri
+			dialURI.User = nil
+			var tlsCfg *tls.Config
+			if uri.Scheme == "wss" {
+				tlsCfg = opts.TLSConfig
+			}
+			conn, err = mqtt.NewWebsocket(dialURI.String(), tlsCfg,
+				PROBE_TIMEOUT, opts.HTTPHeaders, opts.WebsocketOptions)
+			return dialURI.String(), err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// probeTLS performs the TLS handshake on the supplied connection and
+// reports the peer certificate chain, its expiry and the host name match.
+func probeTLS(conn net.Conn, tlsCfg *tls.Config,
+	host string) (*tls.Conn, error) {
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	// Verification is done separately for precise errors
+	probeCfg := tlsCfg.Clone()
+	probeCfg.InsecureSkipVerify = true
+	if len(probeCfg.ServerName) == 0 {
+		probeCfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, probeCfg)
+	err := probeStep("TLS", func() (string, error) {
+		conn.SetDeadline(time.Now().Add(PROBE_TIMEOUT))
+		defer conn.SetDeadline(time.Time{})
+		if err := tlsConn.Handshake(); err != nil {
+			return "", err
+		}
+		state := tlsConn.ConnectionState()
+		return fmt.Sprintf("%s with %s", tls.VersionName(state.Version),
+			tls.CipherSuiteName(state.CipherSuite)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	for i, c := range certs {
+		log.Printf("[Probe]   Certificate %d: %q issued by %q, expires %s\n",
+			i, c.Subject, c.Issuer, c.NotAfter.Format(time.RFC3339))
+	}
+	err = probeCertificates(certs, tlsCfg.RootCAs, probeCfg.ServerName,
+		time.Now())
+	if err != nil && tlsCfg.InsecureSkipVerify {
+		log.Println("[Probe][WARNING] Ignored as certificate verification " +
+			"is disabled")
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// probeCertificates verifies the peer certificate chain against the roots,
+// which are the system roots if nil, along with its expiry and the match
+// of the server name in the certificate.
+func probeCertificates(certs []*x509.Certificate, roots *x509.CertPool,
+	serverName string, now time.Time) error {
+	if len(certs) == 0 {
+		return probeStep("Chain", func() (string, error) {
+			return "", fmt.Errorf("no peer certificates")
+		})
+	}
+	leaf := certs[0]
+	errChain := probeStep("Chain", func() (string, error) {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+		})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d certificate(s) trusted", len(certs)), nil
+	})
+	errExpiry := probeStep("Expiry", func() (string, error) {
+		if now.Before(leaf.NotBefore) {
+			return "", fmt.Errorf("certificate not valid before %s",
+				leaf.NotBefore.Format(time.RFC3339))
+		}
+		left := leaf.NotAfter.Sub(now)
+		if left < 0 {
+			return "", fmt.Errorf("certificate expired on %s",
+				leaf.NotAfter.Format(time.RFC3339))
+		}
+		if left < PROBE_CERT_WARN {
+			log.Printf("[Probe][WARNING] Certificate expires soon on %s\n",
+				leaf.NotAfter.Format(time.RFC3339))
+		}
+		return fmt.Sprintf("%d day(s) left", int(left.Hours()/24)), nil
+	})
+	errSAN := probeStep("SAN", func() (string, error) {
+		if err := leaf.VerifyHostname(serverName); err != nil {
+			return "", fmt.Errorf("%v\n names in certificate: %v",
+				err, append(leaf.DNSNames, ipStrings(leaf.IPAddresses)...))
+		}
+		return fmt.Sprintf("%q matches", serverName), nil
+	})
+	for _, err := range []error{errChain, errExpiry, errSAN} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipStrings converts the supplied IP addresses into strings.
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
+
+// probeConnect sends the MQTT CONNECT packet on the supplied connection
+// and checks the return code in the CONNACK packet. The password comes
+// from the credentials provider if configured.
+func probeConnect(conn net.Conn, m cfg) error {
+	password := m.Password
+	if usesCredentials(m.Credentials) {
+		err := probeStep("Password", func() (string, error) {
+			var err error
+			password, err = fetchPassword(m.Credentials)
+			return fmt.Sprintf("%d characters", len(password)), err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return probeStep("CONNACK", func() (string, error) {
+		conn.SetDeadline(time.Now().Add(PROBE_TIMEOUT))
+		defer conn.SetDeadline(time.Time{})
+
+		cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		// Same protocol as the logger, MQTT 3.1.1 by default
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = PROTOCOL_MQTT311
+		if m.ProtocolVersion == PROTOCOL_MQTT31 {
+			cp.ProtocolName = "MQIsdp"
+			cp.ProtocolVersion = PROTOCOL_MQTT31
+		}
+		cp.CleanSession = true
+		cp.Keepalive = PROBE_KEEPALIVE
+		if len(m.ClientID) > 0 {
+			cp.ClientIdentifier = m.ClientID + PROBE_CLIENT_SUFFIX
+		}
+		if len(m.Username) > 0 {
+			cp.UsernameFlag = true
+			cp.Username = m.Username
+			cp.PasswordFlag = true
+			cp.Password = []byte(password)
+		}
+		if err := cp.Write(conn); err != nil {
+			return "", fmt.Errorf("failed to send CONNECT:\n %v", err)
+		}
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return "", fmt.Errorf("no CONNACK received:\n %v", err)
+		}
+		ca, ok := pkt.(*packets.ConnackPacket)
+		if !ok {
+			return "", fmt.Errorf("expected CONNACK, got %s", pkt)
+		}
+		if ca.ReturnCode != packets.Accepted {
+			return "", fmt.Errorf("return code %d - %s", ca.ReturnCode,
+				packets.ConnackReturnCodes[ca.ReturnCode])
+		}
+		return fmt.Sprintf("return code %d - %s as %q", ca.ReturnCode,
+			packets.ConnackReturnCodes[ca.ReturnCode],
+			cp.ClientIdentifier), nil
+	})
+}
+
+// probeSubscribe sends a test SUBSCRIBE packet for each of the enabled
+// topics on the supplied connection and checks the granted QoS.
+// The connection is closed with a DISCONNECT packet at the end.
+func probeSubscribe(conn net.Conn, topics []topic) error {
+	var failed error
+	id := uint16(1)
+	for _, t := range topics {
+		if !t.Enabled {
+			continue
+		}
+		err := probeStep("SUBACK", func() (string, error) {
+			conn.SetDeadline(time.Now().Add(PROBE_TIMEOUT))
+			defer conn.SetDeadline(time.Time{})
+
+			sp := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			sp.MessageID = id
+			sp.Topics = []string{t.Filter}
+			sp.Qoss = []byte{t.QoS}
+			if err := sp.Write(conn); err != nil {
+				return "", fmt.Errorf("failed to send SUBSCRIBE %q:\n %v",
+					t.Filter, err)
+			}
+			// Retained messages may arrive before the SUBACK
+			for {
+				pkt, err := packets.ReadPacket(conn)
+				if err != nil {
+					return "", fmt.Errorf("no SUBACK received for %q:\n %v",
+						t.Filter, err)
+				}
+				sa, ok := pkt.(*packets.SubackPacket)
+				if !ok || sa.MessageID != id {
+					continue
+				}
+				if len(sa.ReturnCodes) == 0 {
+					return "", fmt.Errorf("empty SUBACK for %q", t.Filter)
+				}
+				granted := sa.ReturnCodes[0]
+				err = checkSubAck(t, map[string]byte{t.Filter: granted})
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%q granted QoS %d", t.Filter, granted), nil
+			}
+		})
+		if err != nil && failed == nil {
+			failed = err
+		}
+		id++
+	}
+	dp := packets.NewControlPacket(packets.Disconnect)
+	dp.Write(conn)
+	return failed
+}
@@ -0,0 +1,357 @@
+// probe_test.go - Connection Diagnostics Tests
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Connection Diagnostics - Tests
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// startProbeBroker starts a minimal Broker that answers the CONNECT with
+// the supplied return code and the SUBSCRIBE with the supplied codes for
+// each filter, granting QoS 1 otherwise. Only the supplied protocol
+// version is accepted, MQTT 3.1.1 if zero. It returns the Broker address.
+func startProbeBroker(t *testing.T, l net.Listener, version, connack byte,
+	suback map[string]byte) string {
+	name := "MQTT"
+	switch version {
+	case 0:
+		version = PROTOCOL_MQTT311
+	case PROTOCOL_MQTT31:
+		name = "MQIsdp"
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			pkt, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			switch p := pkt.(type) {
+			case *packets.ConnectPacket:
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				ca.ReturnCode = connack
+				if p.ProtocolName != name || p.ProtocolVersion != version {
+					ca.ReturnCode = packets.ErrRefusedBadProtocolVersion
+				}
+				ca.Write(conn)
+			case *packets.SubscribePacket:
+				sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				sa.MessageID = p.MessageID
+				for _, f := range p.Topics {
+					code, ok := suback[f]
+					if !ok {
+						code = 1
+					}
+					sa.ReturnCodes = append(sa.ReturnCodes, code)
+				}
+				sa.Write(conn)
+			case *packets.DisconnectPacket:
+				return
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+// writeTestServerCert generates a self-signed server certificate for
+// 127.0.0.1 valid till the supplied time, and writes it as the CA file.
+func writeTestServerCert(t *testing.T, notAfter time.Time) (tls.Certificate,
+	*x509.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "go-mli-test-broker"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "test-ca.crt")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		cert, caFile
+}
+
+func Test_probeBroker(t *testing.T) {
+	serverCert, _, caFile := writeTestServerCert(t, time.Now().Add(time.Hour))
+	tcpListener := func(t *testing.T) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		return l
+	}
+	tlsListener := func(t *testing.T) net.Listener {
+		return tls.NewListener(tcpListener(t), &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+		})
+	}
+	tests := []struct {
+		name     string
+		m        cfg
+		listener func(t *testing.T) net.Listener
+		scheme   string
+		connack  byte
+		suback   map[string]byte
+		wantErr  bool
+	}{
+		{
+			name: "Connect and Subscribe",
+			m: cfg{
+				ClientID: "go-mli-probe-test",
+				Username: "user",
+				Password: "pass",
+				Topics:   []topic{newTopic("demo/#"), newTopic("test")},
+			},
+			listener: tcpListener,
+			scheme:   "tcp",
+		},
+		{
+			name: "Connect with MQTT 3.1",
+			m: cfg{
+				ProtocolVersion: PROTOCOL_MQTT31,
+				Topics:          []topic{newTopic("demo/#")},
+			},
+			listener: tcpListener,
+			scheme:   "tcp",
+		},
+		{
+			name: "TLS with CA File",
+			m: cfg{
+				CAFile: caFile,
+				Topics: []topic{newTopic("demo/#")},
+			},
+			listener: tlsListener,
+			scheme:   "ssl",
+		},
+		{
+			name: "Negative Test - TLS Unknown Authority",
+			m: cfg{
+				TLS:    tlsOptions{ServerName: "localhost"},
+				Topics: []topic{newTopic("demo/#")},
+			},
+			listener: tlsListener,
+			scheme:   "ssl",
+			wantErr:  true,
+		},
+		{
+			name: "Negative Test - TLS Name Mismatch",
+			m: cfg{
+				CAFile: caFile,
+				TLS:    tlsOptions{ServerName: "broker.example.com"},
+				Topics: []topic{newTopic("demo/#")},
+			},
+			listener: tlsListener,
+			scheme:   "ssl",
+			wantErr:  true,
+		},
+		{
+			name: "Negative Test - Not Authorized",
+			m: cfg{
+				Username: "user",
+				Topics:   []topic{newTopic("demo/#")},
+			},
+			listener: tcpListener,
+			scheme:   "tcp",
+			connack:  packets.ErrRefusedNotAuthorised,
+			wantErr:  true,
+		},
+		{
+			name: "Negative Test - Subscription Denied",
+			m: cfg{
+				Topics: []topic{newTopic("demo/#"), newTopic("secret/#")},
+			},
+			listener: tcpListener,
+			scheme:   "tcp",
+			suback:   map[string]byte{"secret/#": SUBACK_FAILURE},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startProbeBroker(t, tt.listener(t), tt.m.ProtocolVersion,
+				tt.connack, tt.suback)
+			opts, err := setupMQTT(tt.m, func() {}, newDispatcher(tt.m, dummyRecorderFn(t)))
+			if err != nil {
+				t.Fatalf("setupMQTT() error = %v", err)
+			}
+			err = probeBroker(tt.m, opts, tt.scheme+"://"+addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probeBroker() error = %v, wantErr %v",
+					err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_probeBroker_Unreachable(t *testing.T) {
+	tests := []struct {
+		name   string
+		broker string
+	}{
+		{
+			name:   "Negative Test - Connection Refused",
+			broker: "tcp://127.0.0.1:1",
+		},
+		{
+			name:   "Negative Test - Unknown Scheme",
+			broker: "gopher://127.0.0.1",
+		},
+		{
+			name:   "Negative Test - DNS Failure",
+			broker: "tcp://go-mli.invalid:1883",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := cfg{Topics: []topic{newTopic("demo/#")}}
+			opts, err := setupMQTT(m, func() {}, newDispatcher(m, dummyRecorderFn(t)))
+			if err != nil {
+				t.Fatalf("setupMQTT() error = %v", err)
+			}
+			if err := probeBroker(m, opts, tt.broker); err == nil {
+				t.Errorf("probeBroker() expected an error")
+			}
+		})
+	}
+}
+
+func Test_probeCertificates(t *testing.T) {
+	_, cert, _ := writeTestServerCert(t, time.Now().Add(time.Hour))
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	tests := []struct {
+		name       string
+		roots      *x509.CertPool
+		serverName string
+		now        time.Time
+		wantErr    bool
+	}{
+		{
+			name:       "Trusted Certificate",
+			roots:      roots,
+			serverName: "127.0.0.1",
+			now:        time.Now(),
+		},
+		{
+			name:       "Trusted Certificate by DNS Name",
+			roots:      roots,
+			serverName: "localhost",
+			now:        time.Now(),
+		},
+		{
+			name:       "Negative Test - Unknown Authority",
+			roots:      x509.NewCertPool(),
+			serverName: "127.0.0.1",
+			now:        time.Now(),
+			wantErr:    true,
+		},
+		{
+			name:       "Negative Test - Name Mismatch",
+			roots:      roots,
+			serverName: "broker.example.com",
+			now:        time.Now(),
+			wantErr:    true,
+		},
+		{
+			name:       "Negative Test - Expired",
+			roots:      roots,
+			serverName: "127.0.0.1",
+			now:        time.Now().Add(2 * time.Hour),
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := probeCertificates([]*x509.Certificate{cert}, tt.roots,
+				tt.serverName, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probeCertificates() error = %v, wantErr %v",
+					err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+// proxy.go - Proxy Connection Handler
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Proxy Connection Handler
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// proxyPorts are the default ports for the supported proxy schemes.
+var proxyPorts = map[string]string{
+	"socks5":  "1080",
+	"socks5h": "1080",
+	"http":    "8080",
+	"https":   "443",
+}
+
+func init() {
+	// HTTP CONNECT proxies in addition to the SOCKS5 support
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+	proxy.RegisterDialerType("https", newHTTPConnectDialer)
+}
+
+// httpConnectDialer tunnels the connections through a HTTP proxy
+// using the CONNECT method.
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+// newHTTPConnectDialer creates the HTTP CONNECT dialer for the supplied
+// proxy URL, in the form needed by proxy.RegisterDialerType.
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpConnectDialer{proxyURL: u, forward: forward}, nil
+}
+
+// Dial implements the proxy.Dialer interface.
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements the proxy.ContextDialer interface. The deadline
+// of the context also limits the TLS handshake and the CONNECT exchange
+// with the proxy.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network,
+	addr string) (net.Conn, error) {
+	conn, err := dialContext(ctx, d.forward, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy %q:\n %v",
+			d.proxyURL.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Secure connection to the proxy itself
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: d.proxyURL.Hostname(),
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed TLS with proxy %q:\n %v",
+				d.proxyURL.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxyURL.User; u != nil {
+		pw, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString(
+			[]byte(u.Username() + ":" + pw))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy:\n %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response:\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %q: %s",
+			addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// Keep any data already read after the response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// dialContext dials through the dialer within the context if supported.
+func dialContext(ctx context.Context, d proxy.Dialer, network,
+	addr string) (net.Conn, error) {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// bufferedConn is a net.Conn that first reads the data left in a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements the io.Reader interface.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// proxyEnv returns the first non empty value among the supplied
+// environment variables.
+func proxyEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// noProxy reports if the host is excluded from the proxy by the
+// NO_PROXY environment variable.
+func noProxy(host string) bool {
+	for _, p := range strings.Split(proxyEnv("NO_PROXY", "no_proxy"), ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if len(p) == 0 {
+			continue
+		}
+		if p == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if ip := net.ParseIP(host); ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		p = strings.TrimPrefix(p, ".")
+		h := strings.ToLower(host)
+		if h == p || strings.HasSuffix(h, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveProxy finds the proxy to use for reaching the supplied Broker
+// host. It returns nil when the connection should be direct.
+func resolveProxy(p proxyOptions, host string) (*url.URL, error) {
+	raw := p.URL
+	if len(raw) == 0 {
+		if !p.FromEnvironment || noProxy(host) {
+			return nil, nil
+		}
+		raw = proxyEnv("ALL_PROXY", "all_proxy",
+			"HTTPS_PROXY", "https_proxy")
+		if len(raw) == 0 {
+			return nil, nil
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q:\n %v", raw, err)
+	}
+	port, ok := proxyPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if len(u.Port()) == 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	if len(p.Username) > 0 {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u, nil
+}
+
+// websocketProxy resolves the proxy for the supplied WebSocket Broker
+// host. The WebSocket dialer only knows the http and socks5 schemes, its
+// socks5 already leaves the name resolution to the proxy as socks5h.
+func websocketProxy(p proxyOptions, host string) (*url.URL, error) {
+	u, err := resolveProxy(p, host)
+	if err != nil || u == nil {
+		return u, err
+	}
+	switch u.Scheme {
+	case "socks5h":
+		u.Scheme = "socks5"
+	case "https":
+		return nil, fmt.Errorf("proxy scheme %q is not supported for "+
+			"WebSocket addresses", u.Scheme)
+	}
+	return u, nil
+}
+
+// usesProxy reports if the supplied proxy configuration is active.
+func usesProxy(p proxyOptions) bool {
+	return len(p.URL) > 0 || p.FromEnvironment
+}
+
+// proxyConnection creates the function to open the network connections to
+// the Broker through the configured proxy for the TCP, TLS and WebSocket
+// addresses.
+func proxyConnection(p proxyOptions) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		var forward proxy.Dialer = proxy.Direct
+		if options.Dialer != nil {
+			forward = options.Dialer
+		}
+
+		switch uri.Scheme {
+		case "ws", "wss":
+			// Proxy is applied through the WebSocket options
+			dialURI := *uri
+			dialURI.User = nil
+			var tlsCfg *tls.Config
+			if uri.Scheme == "wss" {
+				tlsCfg = options.TLSConfig
+			}
+			return mqtt.NewWebsocket(dialURI.String(), tlsCfg,
+				options.ConnectTimeout, options.HTTPHeaders,
+				options.WebsocketOptions)
+		case "unix":
+			addr := uri.Host
+			if len(addr) == 0 {
+				addr = uri.Path
+			}
+			return forward.Dial("unix", addr)
+		}
+
+		// TCP and TLS addresses
+		d := forward
+		pURL, err := resolveProxy(p, uri.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		if pURL != nil {
+			d, err = proxy.FromURL(pURL, forward)
+			if err != nil {
+				return nil, fmt.Errorf("failed to setup proxy %q:\n %v",
+					pURL.Redacted(), err)
+			}
+		}
+		// paho limits the connection only after it is opened, hence the
+		// proxy and TLS handshakes need their own limit
+		ctx := context.Background()
+		if options.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+			defer cancel()
+		}
+		conn, err := dialContext(ctx, d, "tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		switch uri.Scheme {
+		case "mqtt", "tcp":
+			return conn, nil
+		case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+			tlsCfg := &tls.Config{}
+			if options.TLSConfig != nil {
+				tlsCfg = options.TLSConfig.Clone()
+			}
+			if len(tlsCfg.ServerName) == 0 {
+				tlsCfg.ServerName = uri.Hostname()
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			tlsConn := tls.Client(conn, tlsCfg)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			return tlsConn, nil
+		}
+		conn.Close()
+		return nil, fmt.Errorf("unknown protocol %q", uri.Scheme)
+	}
+}
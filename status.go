@@ -0,0 +1,174 @@
+// status.go - Logger Status Messages
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Logger Status Messages
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Status published after connecting to the Broker
+	STATUS_ONLINE = "online"
+	// Status published by the Broker as Last Will upon connection loss
+	STATUS_OFFLINE = "offline"
+	// Status published upon normal shutdown
+	STATUS_STOPPED = "stopped"
+	// Time to wait for the status message to be published
+	STATUS_TIMEOUT = 5 * time.Second
+)
+
+// statusPayload is the content of the status messages.
+type statusPayload struct {
+	Status   string
+	Version  string
+	ClientID string
+	Start    time.Time
+	Time     time.Time
+	Messages uint64
+}
+
+// loggerStatus publishes the retained status messages of the logger
+// on the configured status topic, so that monitoring can tell whether
+// the logger is still recording.
+type loggerStatus struct {
+	m        statusOptions
+	clientID string
+	start    time.Time
+	messages atomic.Uint64
+}
+
+// newLoggerStatus creates the status publisher for the supplied
+// configuration, with "{clientid}" in the topic replaced by the Client ID.
+func newLoggerStatus(m cfg) *loggerStatus {
+	m.Status.Topic = strings.ReplaceAll(m.Status.Topic, "{clientid}",
+		m.ClientID)
+	return &loggerStatus{
+		m:        m.Status,
+		clientID: m.ClientID,
+		start:    time.Now(),
+	}
+}
+
+// enabled reports if the status topic is configured.
+func (s *loggerStatus) enabled() bool {
+	return len(s.m.Topic) > 0
+}
+
+// payload generates the status message for the supplied status.
+func (s *loggerStatus) payload(status string) []byte {
+	bs, _ := json.Marshal(statusPayload{
+		Status:   status,
+		Version:  version,
+		ClientID: s.clientID,
+		Start:    s.start,
+		Time:     time.Now(),
+		Messages: s.messages.Load(),
+	})
+	return bs
+}
+
+// countRecorder wraps the recorder to count the messages received from
+// the Broker, leaving out the records of the logger itself.
+func (s *loggerStatus) countRecorder(rec recorderFn) recorderFn {
+	return func(s1, s2 string, meta *msgMeta) {
+		if meta != nil {
+			s.messages.Add(1)
+		}
+		rec(s1, s2, meta)
+	}
+}
+
+// setup registers the Last Will and the birth message on every connection
+// into the supplied MQTT options.
+func (s *loggerStatus) setup(opts *mqtt.ClientOptions) error {
+	if !s.enabled() {
+		return nil
+	}
+	if s.m.QoS > 2 {
+		return fmt.Errorf("invalid qos %d for status topic %q",
+			s.m.QoS, s.m.Topic)
+	}
+	opts.SetBinaryWill(s.m.Topic, s.payload(STATUS_OFFLINE), s.m.QoS, true)
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if err := s.publish(client, STATUS_ONLINE); err != nil {
+			log.Printf("[Status][ERROR] %v\n", err)
+		}
+		if onConnect != nil {
+			onConnect(client)
+		}
+	})
+	return nil
+}
+
+// publish sends the supplied status as a retained message.
+func (s *loggerStatus) publish(client mqtt.Client, status string) error {
+	if !s.enabled() {
+		return nil
+	}
+	if client == nil {
+		return fmt.Errorf("no client")
+	}
+	token := client.Publish(s.m.Topic, s.m.QoS, true, s.payload(status))
+	if !token.WaitTimeout(STATUS_TIMEOUT) {
+		return fmt.Errorf("timeout publishing status %q to %q",
+			status, s.m.Topic)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("failed to publish status %q to %q:\n %v",
+			status, s.m.Topic, token.Error())
+	}
+	log.Printf("[Status] Published %q to %q\n", status, s.m.Topic)
+	return nil
+}
@@ -0,0 +1,135 @@
+// status_test.go - Logger Status Messages Tests
+//
+//     ॐ भूर्भुवः स्वः
+//     तत्स॑वि॒तुर्वरे॑ण्यं॒
+//    भर्गो॑ दे॒वस्य॑ धीमहि।
+//   धियो॒ यो नः॑ प्रचो॒दया॑त्॥
+//
+//
+// बोसजी के द्वारा रचित गो-मिल तन्त्राक्ष्
+// ============================
+//
+// यह गो-क्रमादेश आधारित एम.क्यू.टी.टी अधिलेख में प्रचालेखन का तन्त्राक्ष् है।
+//
+// एक रचनात्मक भारतीय उत्पाद।
+//
+// go-mli - Boseji's Golang MQTT Logging command line
+//
+// Easy to use Golang based MQTT Command line logger.
+//
+// Sources
+// -------
+// https://github.com/boseji/go-mli
+//
+// License
+// -------
+//
+//   go-mli - Boseji's Golang MQTT Logging command line
+//   Copyright (C) 2024 by Abhijit Bose (aka. Boseji)
+//
+//   This program is free software: you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License version 2 only
+//   as published by the Free Software Foundation.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+//   You should have received a copy of the GNU General Public License
+//   along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+//  SPDX-License-Identifier: GPL-2.0-only
+//  Full Name: GNU General Public License v2.0 only
+//  Please visit <https://spdx.org/licenses/GPL-2.0-only.html> for details.
+//
+
+// Logger Status Messages - Tests
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func Test_loggerStatus_setup(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       cfg
+		wantErr bool
+		checkFn func(t *testing.T, opts *mqtt.ClientOptions)
+	}{
+		{
+			name: "Status Disabled",
+			m:    cfg{ClientID: "go-mli-status-test"},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if opts.WillEnabled {
+					t.Errorf("failed to keep the will disabled")
+				}
+			},
+		},
+		{
+			name: "Status with Last Will",
+			m: cfg{
+				ClientID: "go-mli-status-test",
+				Status: statusOptions{Topic: "go-mli/{clientid}/status",
+					QoS: 1},
+			},
+			checkFn: func(t *testing.T, opts *mqtt.ClientOptions) {
+				if !opts.WillEnabled || !opts.WillRetained ||
+					opts.WillTopic != "go-mli/go-mli-status-test/status" ||
+					opts.WillQos != 1 {
+					t.Errorf("failed to set the will: %q %d %v",
+						opts.WillTopic, opts.WillQos, opts.WillRetained)
+				}
+				var p statusPayload
+				if err := json.Unmarshal(opts.WillPayload, &p); err != nil {
+					t.Fatalf("failed to decode the will: %v", err)
+				}
+				if p.Status != STATUS_OFFLINE || p.Version != version ||
+					p.ClientID != "go-mli-status-test" {
+					t.Errorf("failed to get correct will payload: %+v", p)
+				}
+				if opts.OnConnect == nil {
+					t.Errorf("failed to set the birth message handler")
+				}
+			},
+		},
+		{
+			name: "Negative Test - Invalid QoS",
+			m: cfg{
+				Status: statusOptions{Topic: "go-mli/test/status", QoS: 3},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := mqtt.NewClientOptions()
+			err := newLoggerStatus(tt.m).setup(opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			tt.checkFn(t, opts)
+		})
+	}
+}
+
+func Test_loggerStatus_countRecorder(t *testing.T) {
+	st := newLoggerStatus(cfg{ClientID: "go-mli-status-test"})
+	rec := st.countRecorder(dummyRecorderFn(t))
+	rec("demo", "1", &msgMeta{QoS: 1})
+	rec(MARKER_TOPIC, "reconnected", nil)
+	rec("demo", "2", &msgMeta{QoS: 1})
+	var p statusPayload
+	if err := json.Unmarshal(st.payload(STATUS_STOPPED), &p); err != nil {
+		t.Fatalf("failed to decode the payload: %v", err)
+	}
+	if p.Messages != 2 || p.Status != STATUS_STOPPED {
+		t.Errorf("failed to get correct payload: %+v", p)
+	}
+}
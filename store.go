@@ -50,11 +50,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -64,30 +71,49 @@ const (
 	STORE_PERM = 0644
 	// Header for Log File
 	STORE_HEADER = "Time Stamp,Topic,Data"
+	// Column added to the Log File with multiple Brokers
+	STORE_BROKER_COLUMN = "Broker"
+	// Column added to the Log File with an Instance ID
+	STORE_INSTANCE_COLUMN = "Instance"
+	// Time Stamp format for the records
+	// - Special Time format to help with automatic time recognition
+	//    under the LibreOffice Calc for time stamp in 'CSV' format.
+	STORE_TIME_FORMAT = "2006-01-02T15:04:05" /*time.RFC3339*/
+	// Time Stamp format with milliseconds for the Instance logs, such
+	// that the records of several Instances merge in order
+	STORE_TIME_FORMAT_MS = "2006-01-02T15:04:05.000"
+	// Names of the optional message metadata columns
+	META_QOS        = "QoS"
+	META_RETAINED   = "Retained"
+	META_DUPLICATE  = "Duplicate"
+	META_MESSAGE_ID = "MessageID"
+	// Names of the optional MQTT 5 property columns
+	META_CONTENT_TYPE     = "ContentType"
+	META_CORRELATION_DATA = "CorrelationData"
+	META_MESSAGE_EXPIRY   = "MessageExpiry"
+	META_RESPONSE_TOPIC   = "ResponseTopic"
+	META_USER_PROPERTIES  = "UserProperties"
+	// Prefix of the Broker statistics topics
+	SYS_PREFIX = "$SYS/"
+	// Column for the numeric value of the Broker statistics
+	SYS_VALUE_COLUMN = "Value"
+	// Depth of the channel for the Broker statistics
+	SYS_DEPTH = 64
 )
 
 // storeGoroutine is a Go process that waits for a record to be generated
-// then it writes the same into the supplied filename.
+// then it writes the same into the supplied filename. The header is
+// written first when the file is created. A file name received on the
+// rotate channel switches the storage to that file.
 func storeGoroutine(c <-chan string,
 	ctx context.Context, wg *sync.WaitGroup,
-	storeFile string) {
+	storeFile string, header string, rotate <-chan string) {
 	// Exit with Signalling Completion
 	defer wg.Done()
 	// Check for Files and Write the Header
-	if _, err := os.Stat(storeFile); os.IsNotExist(err) {
-		log.Printf("[Store] Creating log file %q\n", storeFile)
-		// Create a Writable Buffer for String with CSV Format
-		b := bytes.NewBufferString("")
-		w := csv.NewWriter(b)
-		// Create the Record
-		w.Write(strings.Split(STORE_HEADER, ","))
-		w.Flush() // For ce Write to String Buffer
-		// Write File
-		err := os.WriteFile(storeFile, b.Bytes(), STORE_PERM)
-		if err != nil {
-			log.Println("[Store] Could not initialize the log file:\n ", err)
-			return
-		}
+	if err := createStoreFile(storeFile, header); err != nil {
+		log.Println("[Store] Could not initialize the log file:\n ", err)
+		return
 	}
 
 	// Process Loop
@@ -99,6 +125,14 @@ func storeGoroutine(c <-chan string,
 			log.Println("[Store] Cancel detected")
 			return
 
+		case newFile := <-rotate:
+			if err := createStoreFile(newFile, header); err != nil {
+				log.Println("[Store] Could not rotate the log file:\n ", err)
+				continue
+			}
+			log.Printf("[Store] Rotated log file %q to %q\n", storeFile, newFile)
+			storeFile = newFile
+
 		case s, ok := <-c:
 			if !ok {
 				log.Println("[Store] Channel Close detected")
@@ -122,6 +156,23 @@ func storeGoroutine(c <-chan string,
 	}
 }
 
+// createStoreFile creates the log file with the supplied header, unless
+// the file already exists.
+func createStoreFile(storeFile string, header string) error {
+	if _, err := os.Stat(storeFile); !os.IsNotExist(err) {
+		return nil
+	}
+	log.Printf("[Store] Creating log file %q\n", storeFile)
+	// Create a Writable Buffer for String with CSV Format
+	b := bytes.NewBufferString("")
+	w := csv.NewWriter(b)
+	// Create the Record
+	w.Write(strings.Split(header, ","))
+	w.Flush() // For ce Write to String Buffer
+	// Write File
+	return os.WriteFile(storeFile, b.Bytes(), STORE_PERM)
+}
+
 // recordGoroutine is a intermediate process launched to help funnel data
 // to the storage channel. Its designed such that nothing gets blocked
 // when the load increases or there are many competing processes trying
@@ -151,28 +202,247 @@ func recordGoroutine(c chan<- string,
 }
 
 // recorderFn defiles a useful 2 fields function to write a timed
-// record through the recorderGoroutine
-type recorderFn func(string, string)
+// record through the recorderGoroutine, along with the metadata of the
+// MQTT message if available.
+type recorderFn func(string, string, *msgMeta)
+
+// msgMeta stores the metadata of a received MQTT message, along with
+// the properties of MQTT 5 messages.
+type msgMeta struct {
+	QoS             byte
+	Retained        bool
+	Duplicate       bool
+	MessageID       uint16
+	ContentType     string
+	CorrelationData []byte
+	MessageExpiry   *uint32
+	ResponseTopic   string
+	UserProperties  [][2]string
+}
+
+// metaColumns are the supported names for the metadata columns.
+var metaColumns = []string{
+	META_QOS,
+	META_RETAINED,
+	META_DUPLICATE,
+	META_MESSAGE_ID,
+	META_CONTENT_TYPE,
+	META_CORRELATION_DATA,
+	META_MESSAGE_EXPIRY,
+	META_RESPONSE_TOPIC,
+	META_USER_PROPERTIES,
+}
+
+// checkMetaColumns verifies the names of the selected metadata columns.
+func checkMetaColumns(cols []string) error {
+	for _, c := range cols {
+		if !slices.Contains(metaColumns, c) {
+			return fmt.Errorf("unknown column %q, supported are %v",
+				c, metaColumns)
+		}
+	}
+	return nil
+}
+
+// columns returns the values of the selected metadata columns, which
+// are empty for records without metadata.
+func (m *msgMeta) columns(cols []string) []string {
+	values := make([]string, len(cols))
+	if m == nil {
+		return values
+	}
+	for i, c := range cols {
+		switch c {
+		case META_QOS:
+			values[i] = strconv.Itoa(int(m.QoS))
+		case META_RETAINED:
+			values[i] = strconv.FormatBool(m.Retained)
+		case META_DUPLICATE:
+			values[i] = strconv.FormatBool(m.Duplicate)
+		case META_MESSAGE_ID:
+			values[i] = strconv.Itoa(int(m.MessageID))
+		case META_CONTENT_TYPE:
+			values[i] = m.ContentType
+		case META_CORRELATION_DATA:
+			// Binary data as hex to keep the log readable
+			if utf8.Valid(m.CorrelationData) {
+				values[i] = string(m.CorrelationData)
+			} else {
+				values[i] = "0x" + hex.EncodeToString(m.CorrelationData)
+			}
+		case META_MESSAGE_EXPIRY:
+			if m.MessageExpiry != nil {
+				values[i] = strconv.FormatUint(uint64(*m.MessageExpiry), 10)
+			}
+		case META_RESPONSE_TOPIC:
+			values[i] = m.ResponseTopic
+		case META_USER_PROPERTIES:
+			// Key and value pairs as the keys may repeat
+			if len(m.UserProperties) > 0 {
+				bs, _ := json.Marshal(m.UserProperties)
+				values[i] = string(bs)
+			}
+		}
+	}
+	return values
+}
+
+// storeTimeFormat is the Time Stamp format used for the records.
+var storeTimeFormat = STORE_TIME_FORMAT
 
 // getRecorder function generates a recroderFn for the application to use
 // when the recording is needed.
 func getRecorder(c chan string,
 	ctx context.Context, wg *sync.WaitGroup,
 	t time.Duration) recorderFn {
-	return func(s1, s2 string) {
-		// Create a Writable Buffer for String with CSV Format
-		b := bytes.NewBufferString("")
-		w := csv.NewWriter(b)
-		// Create the Record
-		// - Special Time format to help with automatic time recognition
-		//    under the LibreOffice Calc for time stamp in 'CSV' format.
-		w.Write([]string{time.Now().Format("2006-01-02T15:04:05" /*time.RFC3339*/),
-			s1, s2})
-		w.Flush() // For ce Write to String Buffer
-		// Get back the String from CSV
-		s := b.String()
-		// Run the Recorder
-		wg.Add(1)
-		go recordGoroutine(c, ctx, wg, s, t)
+	return func(s1, s2 string, _ *msgMeta) {
+		record(c, ctx, wg, t, s1, s2)
+	}
+}
+
+// getTagRecorder function generates a recorderFn that also records the
+// supplied tags, such as the name of the Broker, before the topic and
+// the selected metadata columns after the data.
+func getTagRecorder(c chan string,
+	ctx context.Context, wg *sync.WaitGroup,
+	t time.Duration, cols []string, tags ...string) recorderFn {
+	return func(s1, s2 string, meta *msgMeta) {
+		fields := append(append([]string{}, tags...), s1, s2)
+		fields = append(fields, meta.columns(cols)...)
+		record(c, ctx, wg, t, fields...)
+	}
+}
+
+// getSysRecorder function generates a recorderFn for the Broker $SYS
+// statistics, which also records the numeric value parsed from the data.
+func getSysRecorder(c chan string,
+	ctx context.Context, wg *sync.WaitGroup,
+	t time.Duration, tags ...string) recorderFn {
+	return func(s1, s2 string, _ *msgMeta) {
+		fields := append(append([]string{}, tags...), s1, s2,
+			parseSysValue(s2))
+		record(c, ctx, wg, t, fields...)
+	}
+}
+
+// sysRecorder routes the records of the Broker $SYS topics to the sysRec
+// and the rest of the records to the rec.
+func sysRecorder(rec, sysRec recorderFn) recorderFn {
+	return func(s1, s2 string, meta *msgMeta) {
+		if strings.HasPrefix(s1, SYS_PREFIX) {
+			sysRec(s1, s2, meta)
+			return
+		}
+		rec(s1, s2, meta)
+	}
+}
+
+// parseSysValue finds the numeric value in the $SYS data such as
+// "1234" or "3600 seconds". It is empty for non numeric data.
+func parseSysValue(s string) string {
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return ""
+	}
+	v, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// storeHeader creates the header for the Log File including the columns
+// for the supplied tags and metadata.
+func storeHeader(tagColumns []string, cols []string) string {
+	h := strings.SplitN(STORE_HEADER, ",", 2)
+	return strings.Join(slices.Concat(h[:1], tagColumns, h[1:], cols), ",")
+}
+
+// record creates a timed record from the supplied fields and sends it
+// through the recordGoroutine.
+func record(c chan string,
+	ctx context.Context, wg *sync.WaitGroup,
+	t time.Duration, fields ...string) {
+	// Create a Writable Buffer for String with CSV Format
+	b := bytes.NewBufferString("")
+	w := csv.NewWriter(b)
+	// Create the Record
+	w.Write(append([]string{time.Now().Format(storeTimeFormat)},
+		fields...))
+	w.Flush() // For ce Write to String Buffer
+	// Get back the String from CSV
+	s := b.String()
+	// Run the Recorder
+	wg.Add(1)
+	go recordGoroutine(c, ctx, wg, s, t)
+}
+
+// mergeLogs combines the supplied CSV log files, such as the ones from
+// several logger Instances, into a single time ordered log file.
+// All the files need to have the same header. The Instance logs have
+// milliseconds in the time stamps, else the records within the same
+// second keep the order of the files.
+func mergeLogs(outFile string, inFiles []string) error {
+	if len(inFiles) == 0 {
+		return fmt.Errorf("no log files to merge")
+	}
+	if _, err := os.Stat(outFile); err == nil {
+		return fmt.Errorf("merged file %q already exists", outFile)
+	}
+
+	type row struct {
+		ts     time.Time
+		fields []string
+	}
+	var header []string
+	var rows []row
+	for _, inFile := range inFiles {
+		bs, err := os.ReadFile(inFile)
+		if err != nil {
+			return fmt.Errorf("failed to read log file %q:\n %v", inFile, err)
+		}
+		r := csv.NewReader(bytes.NewReader(bs))
+		records, err := r.ReadAll()
+		if err != nil {
+			return fmt.Errorf("failed to process log file %q:\n %v",
+				inFile, err)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if header == nil {
+			header = records[0]
+		} else if !slices.Equal(header, records[0]) {
+			return fmt.Errorf("header of %q does not match %v",
+				inFile, header)
+		}
+		for i, rec := range records[1:] {
+			// Fractional seconds are accepted as well
+			ts, err := time.ParseInLocation(STORE_TIME_FORMAT, rec[0],
+				time.Local)
+			if err != nil {
+				return fmt.Errorf("invalid time stamp in %q line %d:\n %v",
+					inFile, i+2, err)
+			}
+			rows = append(rows, row{ts: ts, fields: rec})
+		}
+	}
+
+	// Keep the order of the files for the same time stamp
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].ts.Before(rows[j].ts)
+	})
+
+	b := bytes.NewBufferString("")
+	w := csv.NewWriter(b)
+	w.Write(header)
+	for _, r := range rows {
+		w.Write(r.fields)
+	}
+	w.Flush()
+	err := os.WriteFile(outFile, b.Bytes(), STORE_PERM)
+	if err != nil {
+		return fmt.Errorf("failed to write merged file %q:\n %v", outFile, err)
 	}
+	return nil
 }
@@ -51,6 +51,7 @@ import (
 	"context"
 	"encoding/csv"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -102,7 +103,7 @@ func Test_storeGoroutine(t *testing.T) {
 			c := make(chan string, 2)
 			wg.Add(1)
 			os.Remove(TEST_FILE)
-			go storeGoroutine(c, ctx, &wg, TEST_FILE)
+			go storeGoroutine(c, ctx, &wg, TEST_FILE, STORE_HEADER, nil)
 			time.Sleep(100 * time.Millisecond)
 			tt.fn(t, c)
 			time.Sleep(100 * time.Millisecond)
@@ -115,6 +116,40 @@ func Test_storeGoroutine(t *testing.T) {
 	}
 }
 
+func Test_storeGoroutine_rotate(t *testing.T) {
+	const rotatedFile = "test-rotated.csv"
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan string, 2)
+	rotate := make(chan string)
+	os.Remove(TEST_FILE)
+	os.Remove(rotatedFile)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(rotatedFile)
+	wg.Add(1)
+	go storeGoroutine(c, ctx, &wg, TEST_FILE, STORE_HEADER, rotate)
+	c <- "before\n"
+	time.Sleep(100 * time.Millisecond)
+	rotate <- rotatedFile
+	c <- "after\n"
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	for file, want := range map[string]string{
+		TEST_FILE:   STORE_HEADER + "\nbefore\n",
+		rotatedFile: STORE_HEADER + "\nafter\n",
+	} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", file, err)
+		}
+		if string(content) != want {
+			t.Errorf("content of %q = %q, want %q", file, content, want)
+		}
+	}
+}
+
 func Test_recordGoroutine(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -174,7 +209,7 @@ func Test_getRecorder(t *testing.T) {
 			name: "Working Record",
 			t:    STORE_WAIT * 2,
 			doRecord: func(t *testing.T, rec recorderFn) {
-				rec("Test1", "Test2")
+				rec("Test1", "Test2", nil)
 			},
 			verify: func(t *testing.T, c chan string) {
 				s := <-c
@@ -201,6 +236,187 @@ func Test_getRecorder(t *testing.T) {
 	}
 }
 
+func Test_getTagRecorder(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   []string
+		cols   []string
+		record [2]string
+		meta   *msgMeta
+		check  string
+	}{
+		{
+			name:   "Working Broker Record",
+			tags:   []string{"plant"},
+			record: [2]string{"Test1", "Test2"},
+			check:  ",plant,Test1,Test2",
+		},
+		{
+			name:   "Working Instance and Broker Record",
+			tags:   []string{"i1", "plant"},
+			record: [2]string{"Test1", "Test2"},
+			check:  ",i1,plant,Test1,Test2",
+		},
+		{
+			name:   "Working Metadata Record",
+			cols:   []string{META_QOS, META_RETAINED, META_MESSAGE_ID},
+			record: [2]string{"Test1", "Test2"},
+			meta:   &msgMeta{QoS: 2, Retained: true, MessageID: 42},
+			check:  ",Test1,Test2,2,true,42",
+		},
+		{
+			name: "Working MQTT 5 Properties Record",
+			cols: []string{META_CONTENT_TYPE, META_CORRELATION_DATA,
+				META_MESSAGE_EXPIRY, META_RESPONSE_TOPIC,
+				META_USER_PROPERTIES},
+			record: [2]string{"Test1", "Test2"},
+			meta: &msgMeta{
+				ContentType:     "application/json",
+				CorrelationData: []byte("req-1"),
+				MessageExpiry:   func() *uint32 { v := uint32(60); return &v }(),
+				ResponseTopic:   "reply/1",
+				UserProperties:  [][2]string{{"site", "A"}, {"site", "B"}},
+			},
+			check: `,Test1,Test2,application/json,req-1,60,reply/1,` +
+				`"[[""site"",""A""],[""site"",""B""]]"`,
+		},
+		{
+			name:   "Working Binary Correlation Data Record",
+			cols:   []string{META_CORRELATION_DATA, META_MESSAGE_EXPIRY},
+			record: [2]string{"Test1", "Test2"},
+			meta:   &msgMeta{CorrelationData: []byte{0xff, 0x01}},
+			check:  ",Test1,Test2,0xff01,",
+		},
+		{
+			name:   "Working Record without Metadata",
+			cols:   []string{META_QOS, META_DUPLICATE},
+			record: [2]string{"Test1", "Test2"},
+			check:  ",Test1,Test2,,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			ctx, cancel := context.WithCancel(context.Background())
+			c := make(chan string, 2)
+			rec := getTagRecorder(c, ctx, &wg, STORE_WAIT*2, tt.cols, tt.tags...)
+			rec(tt.record[0], tt.record[1], tt.meta)
+			time.Sleep(STORE_WAIT * 3)
+			cancel()
+			s := <-c
+			if !strings.Contains(s, tt.check) {
+				t.Fatalf("failed to find sub-string \n expected : %s\n got %s",
+					tt.check, s)
+			}
+			close(c)
+			wg.Wait()
+		})
+	}
+}
+
+func Test_storeHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		cols []string
+		want string
+	}{
+		{
+			name: "No Tags",
+			want: STORE_HEADER,
+		},
+		{
+			name: "Instance and Broker",
+			tags: []string{STORE_INSTANCE_COLUMN, STORE_BROKER_COLUMN},
+			want: "Time Stamp,Instance,Broker,Topic,Data",
+		},
+		{
+			name: "Broker and Metadata",
+			tags: []string{STORE_BROKER_COLUMN},
+			cols: []string{META_QOS, META_RETAINED},
+			want: "Time Stamp,Broker,Topic,Data,QoS,Retained",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := storeHeader(tt.tags, tt.cols); got != tt.want {
+				t.Errorf("storeHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkMetaColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		cols    []string
+		wantErr bool
+	}{
+		{
+			name: "All Columns",
+			cols: []string{"QoS", "Retained", "Duplicate", "MessageID"},
+		},
+		{
+			name:    "Negative Test - Unknown Column",
+			cols:    []string{"QoS", "Payload"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMetaColumns(tt.cols)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkMetaColumns() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseSysValue(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "Integer", data: "1234", want: "1234"},
+		{name: "Float", data: "12.50", want: "12.5"},
+		{name: "With Unit", data: "3600 seconds", want: "3600"},
+		{name: "Text", data: "mosquitto version 2.0.18", want: ""},
+		{name: "Empty", data: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSysValue(tt.data); got != tt.want {
+				t.Errorf("parseSysValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sysRecorder(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan string, 2)
+	sysC := make(chan string, 2)
+	rec := sysRecorder(getTagRecorder(c, ctx, &wg, STORE_WAIT*2, nil),
+		getSysRecorder(sysC, ctx, &wg, STORE_WAIT*2))
+	rec("Sensor1/Temp", "21", nil)
+	rec("$SYS/broker/clients/connected", "5", nil)
+	time.Sleep(STORE_WAIT * 3)
+	cancel()
+	s := <-c
+	if !strings.Contains(s, ",Sensor1/Temp,21") {
+		t.Errorf("failed to record the device data: %q", s)
+	}
+	s = <-sysC
+	if !strings.Contains(s, ",$SYS/broker/clients/connected,5,5") {
+		t.Errorf("failed to record the broker statistics: %q", s)
+	}
+	close(c)
+	close(sysC)
+	wg.Wait()
+}
+
 func Test_Storage(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -226,12 +442,12 @@ func Test_Storage(t *testing.T) {
 			c := make(chan string, 2)
 			// Setup Writer
 			wg.Add(1)
-			go storeGoroutine(c, ctx, &wg, TEST_FILE)
+			go storeGoroutine(c, ctx, &wg, TEST_FILE, STORE_HEADER, nil)
 			// Get Writable Function
 			rec := getRecorder(c, ctx, &wg, STORE_WAIT)
 			// Wait and Send data
 			time.Sleep(STORE_WAIT / 2)
-			rec(tt.record[0], tt.record[1])
+			rec(tt.record[0], tt.record[1], nil)
 			time.Sleep(STORE_WAIT * 3)
 			cancel()
 			close(c)
@@ -248,3 +464,87 @@ func Test_Storage(t *testing.T) {
 		})
 	}
 }
+
+func Test_mergeLogs(t *testing.T) {
+	const out = "test-merged.csv"
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Merge Two Instances",
+			files: map[string]string{
+				"test-i1.csv": "Time Stamp,Instance,Topic,Data\n" +
+					"2024-01-01T10:00:00,i1,demo,1\n" +
+					"2024-01-01T10:00:02,i1,demo,3\n",
+				"test-i2.csv": "Time Stamp,Instance,Topic,Data\n" +
+					"2024-01-01T10:00:01,i2,demo,2\n" +
+					"2024-01-01T10:00:03,i2,demo,4\n",
+			},
+			want: "Time Stamp,Instance,Topic,Data\n" +
+				"2024-01-01T10:00:00,i1,demo,1\n" +
+				"2024-01-01T10:00:01,i2,demo,2\n" +
+				"2024-01-01T10:00:02,i1,demo,3\n" +
+				"2024-01-01T10:00:03,i2,demo,4\n",
+		},
+		{
+			name: "Merge Instances within a Second",
+			files: map[string]string{
+				"test-i1.csv": "Time Stamp,Instance,Topic,Data\n" +
+					"2024-01-01T10:00:00.250,i1,demo,2\n" +
+					"2024-01-01T10:00:00.900,i1,demo,4\n",
+				"test-i2.csv": "Time Stamp,Instance,Topic,Data\n" +
+					"2024-01-01T10:00:00.100,i2,demo,1\n" +
+					"2024-01-01T10:00:00.500,i2,demo,3\n",
+			},
+			want: "Time Stamp,Instance,Topic,Data\n" +
+				"2024-01-01T10:00:00.100,i2,demo,1\n" +
+				"2024-01-01T10:00:00.250,i1,demo,2\n" +
+				"2024-01-01T10:00:00.500,i2,demo,3\n" +
+				"2024-01-01T10:00:00.900,i1,demo,4\n",
+		},
+		{
+			name: "Negative Test - Mismatched Header",
+			files: map[string]string{
+				"test-i1.csv": "Time Stamp,Instance,Topic,Data\n",
+				"test-i2.csv": "Time Stamp,Topic,Data\n",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative Test - Invalid Time Stamp",
+			files: map[string]string{
+				"test-i1.csv": "Time Stamp,Topic,Data\nyesterday,demo,1\n",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inFiles []string
+			for f, content := range tt.files {
+				os.WriteFile(f, []byte(content), STORE_PERM)
+				defer os.Remove(f)
+				inFiles = append(inFiles, f)
+			}
+			slices.Sort(inFiles)
+			defer os.Remove(out)
+			err := mergeLogs(out, inFiles)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeLogs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatalf("failed to read the merged file: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("mergeLogs() = \n%s\n want \n%s", got, tt.want)
+			}
+		})
+	}
+}